@@ -0,0 +1,319 @@
+package apirouter
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrApiKeyInvalid is returned when an API key is malformed, unknown or revoked.
+	ErrApiKeyInvalid = &Error{Message: "Invalid API key", Token: "error_api_key_invalid", Code: http.StatusUnauthorized}
+
+	// ErrApiKeyExpired is returned when an API key has expired.
+	ErrApiKeyExpired = &Error{Message: "API key has expired", Token: "error_api_key_expired", Code: http.StatusUnauthorized}
+)
+
+const (
+	apiKeyAlphabet  = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	apiKeyIdLen     = 12
+	apiKeySecretLen = 32
+	apiKeyCrcLen    = 6
+)
+
+// ApiKey is a stored API key. Only a hash of the key is stored, the key itself is only
+// known when it is created.
+type ApiKey struct {
+	Id       string     `json:"id" gorm:"primaryKey;size:32"` // public part of the key
+	Hash     []byte     `json:"-" gorm:"size:32"`             // sha256 of the key
+	Owner    string     `json:"owner" gorm:"index;size:128"`  // who the key acts as, see ApiKeyAuth.Resolve
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes" gorm:"serializer:json"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// ApiKeyStore stores API keys.
+type ApiKeyStore interface {
+	// GetApiKey returns the key with the given id, or ErrNotFound.
+	GetApiKey(ctx context.Context, id string) (*ApiKey, error)
+	// ListApiKeys returns the keys of the given owner.
+	ListApiKeys(ctx context.Context, owner string) ([]*ApiKey, error)
+	// SaveApiKey stores a new key.
+	SaveApiKey(ctx context.Context, k *ApiKey) error
+	// DeleteApiKey removes a key.
+	DeleteApiKey(ctx context.Context, id string) error
+	// TouchApiKey sets the time a key was last used.
+	TouchApiKey(ctx context.Context, id string, t time.Time) error
+}
+
+// ApiKeyAuth authenticates requests with API keys, passed as "Authorization: ApiKey ..."
+// or in a X-Api-Key header. Keys look like:
+//
+//	ak_0N8XgK3p9QbZ_Xq2...<32 characters>...Tz5d9Q
+//
+// that is a prefix, the key id, then the secret followed by a checksum allowing to reject
+// mistyped keys without a store lookup.
+//
+//	auth := &apirouter.ApiKeyAuth{Store: store}
+//	apirouter.RequestHooks = append(apirouter.RequestHooks, auth.Hook)
+//
+//	key, info, err := auth.Create(ctx, user.Id, "deploy bot", []string{"deploy"}, time.Time{})
+type ApiKeyAuth struct {
+	Store  ApiKeyStore
+	Prefix string // prefix of created keys, "ak" if empty, may contain underscores
+
+	// Resolve returns the user for a verified key. If nil, the key is used as the user.
+	Resolve func(c *Context, k *ApiKey) (any, error)
+
+	// LastUsedInterval is the minimum delay between updates of a key's last used time,
+	// 1 minute if zero.
+	LastUsedInterval time.Duration
+}
+
+// Create creates a new key for owner and returns it. The key cannot be retrieved later.
+// A zero expires creates a key that does not expire. The key is restricted to scopes,
+// a key without scopes can only call routes that do not require any, while "*" grants
+// all scopes.
+func (a *ApiKeyAuth) Create(ctx context.Context, owner, name string, scopes []string, expires time.Time) (string, *ApiKey, error) {
+	if scopes == nil {
+		// a nil scope list would mean unrestricted, see SetScopes
+		scopes = []string{}
+	}
+	prefix := a.Prefix
+	if prefix == "" {
+		prefix = "ak"
+	}
+	id, err := apiKeyRandom(apiKeyIdLen)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := apiKeyRandom(apiKeySecretLen)
+	if err != nil {
+		return "", nil, err
+	}
+	key := prefix + "_" + id + "_" + secret
+	key += apiKeyChecksum(key)
+
+	hash := sha256.Sum256([]byte(key))
+	k := &ApiKey{
+		Id:      id,
+		Hash:    hash[:],
+		Owner:   owner,
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	if !expires.IsZero() {
+		k.Expires = &expires
+	}
+	if err := a.Store.SaveApiKey(ctx, k); err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// Revoke deletes the key with the given id.
+func (a *ApiKeyAuth) Revoke(ctx context.Context, id string) error {
+	return a.Store.DeleteApiKey(ctx, id)
+}
+
+// Verify checks key and returns the matching stored key.
+func (a *ApiKeyAuth) Verify(ctx context.Context, key string) (*ApiKey, error) {
+	id, ok := parseApiKey(key)
+	if !ok {
+		return nil, ErrApiKeyInvalid
+	}
+	k, err := a.Store.GetApiKey(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrApiKeyInvalid
+		}
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(key))
+	if subtle.ConstantTimeCompare(hash[:], k.Hash) != 1 {
+		return nil, ErrApiKeyInvalid
+	}
+	now := time.Now()
+	if k.Expires != nil && now.After(*k.Expires) {
+		return nil, ErrApiKeyExpired
+	}
+
+	interval := a.LastUsedInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	if k.LastUsed == nil || now.Sub(*k.LastUsed) >= interval {
+		if err := a.Store.TouchApiKey(ctx, k.Id, now); err == nil {
+			k.LastUsed = &now
+		}
+	}
+	return k, nil
+}
+
+// Hook is a RequestHook authenticating requests with an API key. Requests without a key
+// are left untouched. On success, the request's user and scopes are set from the key, and
+// the key is available as the "@api_key" object.
+func (a *ApiKeyAuth) Hook(c *Context) error {
+	if c.req == nil {
+		return nil
+	}
+	key := c.req.Header.Get("X-Api-Key")
+	if key == "" {
+		scheme, v, ok := strings.Cut(c.req.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "ApiKey") {
+			return nil
+		}
+		key = strings.TrimSpace(v)
+	}
+
+	k, err := a.Verify(c, key)
+	if err != nil {
+		return err
+	}
+	var user any = k
+	if a.Resolve != nil {
+		user, err = a.Resolve(c, k)
+		if err != nil {
+			return err
+		}
+	}
+	scopes := k.Scopes
+	if scopes == nil {
+		// stores may load an empty list as nil, keys are never unrestricted
+		scopes = []string{}
+	}
+	c.SetObject("@api_key", k)
+	c.SetUser(user)
+	c.SetScopes(scopes)
+	if k.Expires != nil {
+		c.SetUserExpiry(*k.Expires)
+	}
+	return nil
+}
+
+// parseApiKey checks the format and checksum of key, and returns its id.
+func parseApiKey(key string) (string, bool) {
+	if len(key) < apiKeyCrcLen {
+		return "", false
+	}
+	body, crc := key[:len(key)-apiKeyCrcLen], key[len(key)-apiKeyCrcLen:]
+	if apiKeyChecksum(body) != crc {
+		return "", false
+	}
+	// the prefix may contain underscores, such as "sk_live", so split from the right
+	p := strings.LastIndexByte(body, '_')
+	if p == -1 || len(body)-p-1 != apiKeySecretLen {
+		return "", false
+	}
+	body = body[:p]
+	p = strings.LastIndexByte(body, '_')
+	if p < 1 || len(body)-p-1 != apiKeyIdLen {
+		return "", false
+	}
+	return body[p+1:], true
+}
+
+// apiKeyChecksum returns the crc32 of s in base62.
+func apiKeyChecksum(s string) string {
+	n := crc32.ChecksumIEEE([]byte(s))
+	res := make([]byte, apiKeyCrcLen)
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = apiKeyAlphabet[n%62]
+		n /= 62
+	}
+	return string(res)
+}
+
+// apiKeyRandom returns a random base62 string of length n.
+func apiKeyRandom(n int) (string, error) {
+	res := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(res) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// 248 is the largest multiple of 62 below 256, avoid modulo bias
+			if b < 248 && len(res) < n {
+				res = append(res, apiKeyAlphabet[b%62])
+			}
+		}
+	}
+	return string(res), nil
+}
+
+// MemoryApiKeyStore is an [ApiKeyStore] keeping keys in memory, mostly useful for tests.
+type MemoryApiKeyStore struct {
+	keys map[string]*ApiKey
+	lk   sync.RWMutex
+}
+
+// NewMemoryApiKeyStore returns a new empty store.
+func NewMemoryApiKeyStore() *MemoryApiKeyStore {
+	return &MemoryApiKeyStore{keys: make(map[string]*ApiKey)}
+}
+
+func (s *MemoryApiKeyStore) GetApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *k
+	return &cp, nil
+}
+
+func (s *MemoryApiKeyStore) ListApiKeys(ctx context.Context, owner string) ([]*ApiKey, error) {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	var res []*ApiKey
+	for _, k := range s.keys {
+		if k.Owner == owner {
+			cp := *k
+			res = append(res, &cp)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res, nil
+}
+
+func (s *MemoryApiKeyStore) SaveApiKey(ctx context.Context, k *ApiKey) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	cp := *k
+	s.keys[k.Id] = &cp
+	return nil
+}
+
+func (s *MemoryApiKeyStore) DeleteApiKey(ctx context.Context, id string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *MemoryApiKeyStore) TouchApiKey(ctx context.Context, id string, t time.Time) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if k, ok := s.keys[id]; ok {
+		k.LastUsed = &t
+	}
+	return nil
+}
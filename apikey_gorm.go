@@ -0,0 +1,53 @@
+package apirouter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// GormApiKeyStore is an [ApiKeyStore] storing keys in the api_keys table of a GORM
+// database.
+type GormApiKeyStore struct {
+	DB *gorm.DB
+}
+
+// NewGormApiKeyStore returns a store using db, creating or updating the api_keys table.
+func NewGormApiKeyStore(db *gorm.DB) (*GormApiKeyStore, error) {
+	if err := db.AutoMigrate(&ApiKey{}); err != nil {
+		return nil, err
+	}
+	return &GormApiKeyStore{DB: db}, nil
+}
+
+func (s *GormApiKeyStore) GetApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	var k ApiKey
+	err := s.DB.WithContext(ctx).Where("id = ?", id).Take(&k).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s *GormApiKeyStore) ListApiKeys(ctx context.Context, owner string) ([]*ApiKey, error) {
+	var res []*ApiKey
+	err := s.DB.WithContext(ctx).Where("owner = ?", owner).Order("created").Find(&res).Error
+	return res, err
+}
+
+func (s *GormApiKeyStore) SaveApiKey(ctx context.Context, k *ApiKey) error {
+	return s.DB.WithContext(ctx).Create(k).Error
+}
+
+func (s *GormApiKeyStore) DeleteApiKey(ctx context.Context, id string) error {
+	return s.DB.WithContext(ctx).Where("id = ?", id).Delete(&ApiKey{}).Error
+}
+
+func (s *GormApiKeyStore) TouchApiKey(ctx context.Context, id string, t time.Time) error {
+	return s.DB.WithContext(ctx).Model(&ApiKey{}).Where("id = ?", id).Update("last_used", t).Error
+}
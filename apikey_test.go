@@ -0,0 +1,170 @@
+package apirouter_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+func init() {
+	apirouter.RegisterStatic("ApiKeyTest:whoami", func(ctx context.Context) (any, error) {
+		var c *apirouter.Context
+		ctx.Value(&c)
+		k := apirouter.GetUser[apirouter.ApiKey](ctx)
+		if k == nil {
+			return nil, apirouter.ErrAccessDenied
+		}
+		return map[string]any{"owner": k.Owner, "scopes": c.Scopes()}, nil
+	})
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	ctx := context.Background()
+	store := apirouter.NewMemoryApiKeyStore()
+	auth := &apirouter.ApiKeyAuth{Store: store}
+	prev := apirouter.RequestHooks
+	apirouter.RequestHooks = append(apirouter.RequestHooks[:len(prev):len(prev)], auth.Hook)
+	t.Cleanup(func() { apirouter.RequestHooks = prev })
+	apirouter.SetPolicy("ApiKeyTest:whoami", &apirouter.Policy{Scopes: []string{"deploy"}})
+	t.Cleanup(func() { apirouter.SetPolicy("ApiKeyTest:whoami", nil) })
+
+	create := func(scopes []string) string {
+		key, _, err := auth.Create(ctx, "bob", "test", scopes, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	// a key saved with nil scopes, as a store could load it
+	stored, info, err := auth.Create(ctx, "bob", "stored", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Scopes = nil
+	if err := store.SaveApiKey(ctx, info); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		err  string
+	}{
+		{"nil scopes", create(nil), "error_access_denied"},
+		{"empty scopes", create([]string{}), "error_access_denied"},
+		{"nil scopes in store", stored, "error_access_denied"},
+		{"other scope", create([]string{"read"}), "error_access_denied"},
+		{"scope", create([]string{"deploy"}), ""},
+		{"wildcard", create([]string{"*"}), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := apiroutertest.Call(t, "ApiKeyTest:whoami", "GET", nil, apiroutertest.WithHeader("X-Api-Key", tt.key))
+			if tt.err != "" {
+				res.ExpectError(tt.err)
+			} else {
+				res.ExpectSuccess()
+			}
+		})
+	}
+}
+
+func TestApiKeyPrefix(t *testing.T) {
+	for _, prefix := range []string{"", "ak", "sk_live", "sk_test_v2"} {
+		t.Run(prefix, func(t *testing.T) {
+			auth := &apirouter.ApiKeyAuth{Store: apirouter.NewMemoryApiKeyStore(), Prefix: prefix}
+			key, info, err := auth.Create(context.Background(), "bob", "test", nil, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := prefix
+			if want == "" {
+				want = "ak"
+			}
+			if !strings.HasPrefix(key, want+"_"+info.Id+"_") {
+				t.Errorf("unexpected key format %s", key)
+			}
+			k, err := auth.Verify(context.Background(), key)
+			if err != nil {
+				t.Fatalf("failed to verify %s: %s", key, err)
+			}
+			if k.Id != info.Id {
+				t.Errorf("expected key %s, got %s", info.Id, k.Id)
+			}
+		})
+	}
+}
+
+func TestApiKeyAuth(t *testing.T) {
+	ctx := context.Background()
+	auth := &apirouter.ApiKeyAuth{Store: apirouter.NewMemoryApiKeyStore(), Prefix: "sk_live"}
+	prev := apirouter.RequestHooks
+	apirouter.RequestHooks = append(apirouter.RequestHooks[:len(prev):len(prev)], auth.Hook)
+	t.Cleanup(func() { apirouter.RequestHooks = prev })
+
+	key, _, err := auth.Create(ctx, "bob", "test", []string{"deploy"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := auth.Create(ctx, "bob", "old", nil, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, info, err := auth.Create(ctx, "bob", "revoked", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Revoke(ctx, info.Id)
+	other := &apirouter.ApiKeyAuth{Store: apirouter.NewMemoryApiKeyStore(), Prefix: "sk_live"}
+	unknown, _, err := other.Create(ctx, "eve", "unknown", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change one character of the secret, the checksum no longer matches
+	typo := []byte(key)
+	typo[len(typo)-10] ^= 1
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		err    string // expected error token, empty for success
+	}{
+		{"x-api-key", "X-Api-Key", key, ""},
+		{"authorization", "Authorization", "ApiKey " + key, ""},
+		{"no key", "", "", "error_access_denied"},
+		{"other scheme", "Authorization", "Basic " + key, "error_access_denied"},
+		{"typo", "X-Api-Key", string(typo), "error_api_key_invalid"},
+		{"truncated", "X-Api-Key", key[:len(key)-1], "error_api_key_invalid"},
+		{"malformed", "X-Api-Key", "sk_live_nope", "error_api_key_invalid"},
+		{"expired", "X-Api-Key", expired, "error_api_key_expired"},
+		{"revoked", "X-Api-Key", revoked, "error_api_key_invalid"},
+		{"unknown", "X-Api-Key", unknown, "error_api_key_invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []apiroutertest.Option
+			if tt.header != "" {
+				opts = append(opts, apiroutertest.WithHeader(tt.header, tt.value))
+			}
+			res := apiroutertest.Call(t, "ApiKeyTest:whoami", "GET", nil, opts...)
+			if tt.err != "" {
+				res.ExpectError(tt.err)
+				return
+			}
+			var out struct {
+				Owner  string   `json:"owner"`
+				Scopes []string `json:"scopes"`
+			}
+			res.ExpectSuccess().Decode(&out)
+			if out.Owner != "bob" || len(out.Scopes) != 1 || out.Scopes[0] != "deploy" {
+				t.Errorf("unexpected result %+v", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Package apiroutertest provides helpers to test APIs served by apirouter without
+// running a server.
+//
+//	func TestSearch(t *testing.T) {
+//		res := apiroutertest.Call(t, "User:search", "GET", map[string]any{"q": "bob"},
+//			apiroutertest.WithUser(&User{Id: "u1"}))
+//		res.ExpectSuccess()
+//
+//		var users []*User
+//		res.Decode(&users)
+//	}
+package apiroutertest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/pjson"
+)
+
+// Option configures requests made by [Call] and [NewWS].
+type Option func(*config)
+
+type config struct {
+	user    any
+	scopes  []string
+	csrf    bool
+	domain  string
+	objects map[string]any
+	header  http.Header
+	listen  []string
+}
+
+// WithUser sets the user of the request, as if set by a request hook.
+func WithUser(user any) Option {
+	return func(c *config) { c.user = user }
+}
+
+// WithScopes restricts the request to the given scopes, see apirouter.SetScopes.
+func WithScopes(scopes ...string) Option {
+	return func(c *config) { c.scopes = append([]string{}, scopes...) }
+}
+
+// WithCSRF marks the request as having passed CSRF validation.
+func WithCSRF() Option {
+	return func(c *config) { c.csrf = true }
+}
+
+// WithDomain sets the domain (Host header) of the request. The default is "localhost".
+func WithDomain(domain string) Option {
+	return func(c *config) { c.domain = domain }
+}
+
+// WithObject adds an object to the request's context, see apirouter.GetObject.
+func WithObject(typ string, obj any) Option {
+	return func(c *config) { c.objects[typ] = obj }
+}
+
+// WithHeader adds a header to the request, for example to exercise request hooks.
+func WithHeader(key, value string) Option {
+	return func(c *config) { c.header.Add(key, value) }
+}
+
+// WithListen subscribes the request's context to the given channels. This is mostly
+// useful with [NewWS].
+func WithListen(channels ...string) Option {
+	return func(c *config) { c.listen = append(c.listen, channels...) }
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{domain: "localhost", objects: make(map[string]any), header: make(http.Header)}
+	for _, o := range opts {
+		o(cfg)
+	}
+	return cfg
+}
+
+// newRequest builds the http request for a call, passing params the same way as
+// clients do.
+func (cfg *config) newRequest(path, verb string, params any) (*http.Request, error) {
+	target := "http://" + cfg.domain + "/" + strings.TrimLeft(path, "/")
+
+	var body io.Reader
+	if params != nil {
+		js, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		switch verb {
+		case "POST", "PATCH", "PUT":
+			body = bytes.NewReader(js)
+		default:
+			target += "?_=" + url.QueryEscape(string(js))
+		}
+	}
+
+	req := httptest.NewRequest(verb, target, body)
+	for k, v := range cfg.header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	return req, nil
+}
+
+// apply sets the configured state on c.
+func (cfg *config) apply(c *apirouter.Context) {
+	if cfg.user != nil {
+		c.SetUser(cfg.user)
+	}
+	if cfg.scopes != nil {
+		c.SetScopes(cfg.scopes)
+	}
+	if cfg.csrf {
+		c.SetCsrfValidated(true)
+	}
+	for k, v := range cfg.objects {
+		c.SetObject(k, v)
+	}
+	for _, ch := range cfg.listen {
+		c.SetListen(ch, true)
+	}
+}
+
+// Result is the result of [Call].
+type Result struct {
+	*apirouter.Response
+	t testing.TB
+}
+
+// Call runs a request through the full apirouter pipeline (request hooks, routing,
+// response hooks) and returns its response. Params are sent as a JSON body for POST,
+// PATCH and PUT, and in the query string otherwise.
+func Call(t testing.TB, path, verb string, params any, opts ...Option) *Result {
+	t.Helper()
+
+	if verb == "" {
+		verb = "GET"
+	}
+	cfg := newConfig(opts)
+	req, err := cfg.newRequest(path, verb, params)
+	if err != nil {
+		t.Fatalf("apiroutertest: failed to build request: %s", err)
+	}
+	// like net/http, the request's context ends once it was served
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	c, err := apirouter.NewHttp(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("apiroutertest: failed to parse request: %s", err)
+	}
+	cfg.apply(c)
+
+	res, _ := c.Response()
+	return &Result{Response: res, t: t}
+}
+
+// Extra returns an extra value set on the response, see apirouter.SetExtraResponse.
+func (r *Result) Extra(k string) any {
+	return r.GetContext().GetExtraResponse(k)
+}
+
+// Decode encodes the response data to JSON as it would be sent to a client, with
+// protected fields hidden, and decodes it into v.
+func (r *Result) Decode(v any) error {
+	js, err := pjson.MarshalContext(pjson.ContextPublic(r.GetContext()), r.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
+// ExpectSuccess fails the test if the response is not a success.
+func (r *Result) ExpectSuccess() *Result {
+	r.t.Helper()
+	if r.Result != "success" {
+		r.t.Errorf("expected success, got %s: %s (%s)", r.Result, r.Error, r.Token)
+	}
+	return r
+}
+
+// ExpectError fails the test if the response is not an error with the given token.
+func (r *Result) ExpectError(token string) *Result {
+	r.t.Helper()
+	if r.Result != "error" {
+		r.t.Errorf("expected error %s, got %s", token, r.Result)
+	} else if r.Token != token {
+		r.t.Errorf("expected error %s, got %s: %s", token, r.Token, r.Error)
+	}
+	return r
+}
+
+// ExpectCode fails the test if the response code differs from code.
+func (r *Result) ExpectCode(code int) *Result {
+	r.t.Helper()
+	if r.Code != code {
+		r.t.Errorf("expected code %d, got %d", code, r.Code)
+	}
+	return r
+}
+
+// ExpectExtra fails the test if the extra value k of the response is not equal to v.
+func (r *Result) ExpectExtra(k string, v any) *Result {
+	r.t.Helper()
+	if got := r.Extra(k); !reflect.DeepEqual(got, v) {
+		r.t.Errorf("expected extra %s = %#v, got %#v", k, v, got)
+	}
+	return r
+}
@@ -0,0 +1,183 @@
+package apiroutertest_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+type harnessUser struct {
+	Name string `json:"name"`
+}
+
+type harnessShop struct {
+	Id string `json:"id"`
+}
+
+func init() {
+	apirouter.RegisterStatic("Harness:whoami", func(ctx context.Context) (any, error) {
+		u := apirouter.GetUser[harnessUser](ctx)
+		if u == nil {
+			return nil, apirouter.ErrAccessDenied
+		}
+		return u, nil
+	})
+	apirouter.RegisterStatic("Harness:info", func(ctx context.Context) (any, error) {
+		var c *apirouter.Context
+		ctx.Value(&c)
+		c.SetExtraResponse("audit", "seen")
+		shop := apirouter.GetObject[harnessShop](ctx, "Shop")
+		res := map[string]any{
+			"domain": c.GetDomain(),
+			"csrf":   apirouter.SecurePost(ctx) == nil,
+			"header": apirouter.GetHeader(ctx, "X-Test"),
+		}
+		if shop != nil {
+			res["shop"] = shop.Id
+		}
+		return res, nil
+	})
+	apirouter.RegisterStatic("Harness:echo", func(ctx context.Context, in struct{ Value string }) (string, error) {
+		return in.Value, nil
+	})
+	apirouter.RegisterStatic("Harness:progress", func(ctx context.Context) (string, error) {
+		for i := 1; i <= 3; i++ {
+			apirouter.Progress(ctx, map[string]any{"step": i})
+		}
+		return "done", nil
+	})
+	apirouter.RegisterStatic("Harness:notify", func(ctx context.Context, in struct{ Channel string }) (any, error) {
+		return nil, apirouter.SendWS(ctx, in.Channel, map[string]any{"result": "event", "data": "hello"})
+	})
+}
+
+func TestCall(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		verb  string
+		opts  []apiroutertest.Option
+		token string // expected error token, empty for success
+	}{
+		{"anonymous", "Harness:whoami", "GET", nil, "error_access_denied"},
+		{"with user", "Harness:whoami", "GET", []apiroutertest.Option{apiroutertest.WithUser(&harnessUser{Name: "bob"})}, ""},
+		{"not found", "Harness:missing", "GET", nil, "error_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := apiroutertest.Call(t, tt.path, tt.verb, nil, tt.opts...)
+			if tt.token == "" {
+				res.ExpectSuccess().ExpectCode(http.StatusOK)
+			} else {
+				res.ExpectError(tt.token)
+			}
+		})
+	}
+}
+
+func TestCallDecode(t *testing.T) {
+	var u harnessUser
+	res := apiroutertest.Call(t, "Harness:whoami", "GET", nil, apiroutertest.WithUser(&harnessUser{Name: "bob"}))
+	if err := res.ExpectSuccess().Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "bob" {
+		t.Errorf("expected bob, got %q", u.Name)
+	}
+
+	var s string
+	apiroutertest.Call(t, "Harness:echo", "POST", map[string]any{"Value": "posted"}).ExpectSuccess().Decode(&s)
+	if s != "posted" {
+		t.Errorf("expected posted, got %q", s)
+	}
+	apiroutertest.Call(t, "Harness:echo", "GET", map[string]any{"Value": "query"}).ExpectSuccess().Decode(&s)
+	if s != "query" {
+		t.Errorf("expected query, got %q", s)
+	}
+}
+
+func TestCallOptions(t *testing.T) {
+	res := apiroutertest.Call(t, "Harness:info", "POST", map[string]any{},
+		apiroutertest.WithCSRF(),
+		apiroutertest.WithDomain("shop.example"),
+		apiroutertest.WithObject("Shop", &harnessShop{Id: "s1"}),
+		apiroutertest.WithHeader("X-Test", "yes"),
+	)
+	res.ExpectSuccess().ExpectExtra("audit", "seen")
+
+	var info map[string]any
+	if err := res.Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"domain": "shop.example", "csrf": true, "header": "yes", "shop": "s1"}
+	for k, v := range want {
+		if info[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, info[k])
+		}
+	}
+
+	apiroutertest.Call(t, "Harness:info", "GET", nil).Decode(&info)
+	if info["domain"] != "localhost" || info["csrf"] != false {
+		t.Errorf("unexpected defaults: %v", info)
+	}
+}
+
+func TestWS(t *testing.T) {
+	ws := apiroutertest.NewWS(t, apiroutertest.WithUser(&harnessUser{Name: "alice"}))
+
+	res := ws.Call("Harness:whoami", "GET", nil)
+	if res.Err != nil {
+		t.Fatalf("whoami failed: %s", res.Err)
+	}
+	var u harnessUser
+	json.Unmarshal(res.Data, &u)
+	if u.Name != "alice" {
+		t.Errorf("expected alice, got %q", u.Name)
+	}
+
+	res = ws.Call("Harness:progress", "GET", nil)
+	if res.Err != nil {
+		t.Fatalf("progress failed: %s", res.Err)
+	}
+	if len(res.Progress) != 3 {
+		t.Errorf("expected 3 progress reports, got %d", len(res.Progress))
+	}
+}
+
+func TestWSEvents(t *testing.T) {
+	rec := apiroutertest.Record(t)
+	ws := apiroutertest.NewWS(t, apiroutertest.WithListen("harness"))
+
+	if res := ws.Call("Harness:notify", "POST", map[string]any{"Channel": "harness"}); res.Err != nil {
+		t.Fatalf("notify failed: %s", res.Err)
+	}
+	ev := ws.NextEvent(2 * time.Second)
+	if ev == nil {
+		t.Fatal("event not received")
+	}
+	if ev.Result != "event" {
+		t.Errorf("expected event, got %s", ev.Result)
+	}
+
+	// not subscribed
+	ws.Call("Harness:notify", "POST", map[string]any{"Channel": "other"})
+	if ev := ws.NextEvent(100 * time.Millisecond); ev != nil {
+		t.Errorf("unexpected event %s", ev.Result)
+	}
+
+	if n := len(rec.On("harness")); n != 1 {
+		t.Errorf("expected 1 recorded message on harness, got %d", n)
+	}
+	if n := len(rec.Messages()); n != 2 {
+		t.Errorf("expected 2 recorded messages, got %d", n)
+	}
+	rec.Reset()
+	if n := len(rec.Messages()); n != 0 {
+		t.Errorf("expected no messages after reset, got %d", n)
+	}
+}
@@ -0,0 +1,47 @@
+package apiroutertest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+)
+
+// NewHTTPClient returns an http client whose requests are served by the api over
+// in-memory pipes, without opening a network socket. The host of request URLs is
+// ignored, so any base URL such as "http://localhost" can be used. The options apply to
+// every request, including websocket upgrades. The server is closed when the test ends.
+//
+//	c := &client.HTTP{BaseURL: "http://localhost", Client: apiroutertest.NewHTTPClient(t)}
+func NewHTTPClient(t testing.TB, opts ...Option) *http.Client {
+	t.Helper()
+
+	l := newPipeServer(t, newConfig(opts))
+	return &http.Client{Transport: &http.Transport{DialContext: l.dial}}
+}
+
+// newPipeServer serves the api on a new pipe listener until the test ends.
+func newPipeServer(t testing.TB, cfg *config) *pipeListener {
+	var h http.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.Host = cfg.domain
+		for k, v := range cfg.header {
+			req.Header[k] = v
+		}
+		c, err := apirouter.NewHttp(rw, req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg.apply(c)
+		c.ServeHTTP(rw, req)
+	})
+	for k, v := range cfg.objects {
+		// pre-objects are inherited by requests sent on websocket connections
+		h = apirouter.WithObject(h, k, v)
+	}
+	l := newPipeListener()
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l
+}
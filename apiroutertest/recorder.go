@@ -0,0 +1,73 @@
+package apiroutertest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+)
+
+// Recorder is a broker capturing messages sent with apirouter.SendWS and
+// apirouter.BroadcastWS, see [Record].
+type Recorder struct {
+	apirouter.Broker // broker messages are forwarded to
+
+	msgs []*Message
+	lk   sync.Mutex
+}
+
+// Message is a message captured by a [Recorder].
+type Message struct {
+	Channel string // "*" for broadcasts
+	Data    any
+}
+
+// Record installs a [Recorder] as broker until the end of the test. Messages are still
+// delivered through the previous broker, so websocket connections keep receiving them.
+func Record(t testing.TB) *Recorder {
+	prev := apirouter.GetBroker()
+	r := &Recorder{Broker: prev}
+	apirouter.SetBroker(r)
+	t.Cleanup(func() { apirouter.SetBroker(prev) })
+	return r
+}
+
+// Publish implements apirouter.Broker.
+func (r *Recorder) Publish(ctx context.Context, channel string, data any) error {
+	r.lk.Lock()
+	r.msgs = append(r.msgs, &Message{Channel: channel, Data: data})
+	r.lk.Unlock()
+
+	return r.Broker.Publish(ctx, channel, data)
+}
+
+// Messages returns all captured messages.
+func (r *Recorder) Messages() []*Message {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	return append([]*Message(nil), r.msgs...)
+}
+
+// On returns the data of messages captured on the given channel.
+func (r *Recorder) On(channel string) []any {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	var res []any
+	for _, m := range r.msgs {
+		if m.Channel == channel {
+			res = append(res, m.Data)
+		}
+	}
+	return res
+}
+
+// Reset discards captured messages.
+func (r *Recorder) Reset() {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	r.msgs = nil
+}
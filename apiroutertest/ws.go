@@ -0,0 +1,94 @@
+package apiroutertest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter/client"
+	"github.com/coder/websocket"
+)
+
+// WS is an in-memory websocket connection to the api, see [NewWS].
+type WS struct {
+	Conn *client.Conn
+
+	t      testing.TB
+	events chan *client.Response
+}
+
+// WSResult is the result of [WS.Call].
+type WSResult struct {
+	*client.Response
+	Err      error
+	Progress []json.RawMessage // progress reported by the handler, in order
+}
+
+// NewWS opens a websocket connection to the api over an in-memory pipe, without opening
+// a network socket. The options apply to the upgrade request, so WithUser and WithListen
+// set the user and subscriptions of the connection. Messages that are not responses (events, presence, ...) are queued and
+// can be read with [WS.NextEvent]. Everything is closed when the test ends.
+func NewWS(t testing.TB, opts ...Option) *WS {
+	t.Helper()
+
+	cfg := newConfig(opts)
+	l := newPipeServer(t, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wsc, _, err := websocket.Dial(ctx, "ws://"+cfg.domain+"/_websocket", &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &http.Transport{DialContext: l.dial}},
+		HTTPHeader: cfg.header,
+	})
+	if err != nil {
+		t.Fatalf("apiroutertest: websocket connection failed: %s", err)
+	}
+	conn := client.NewWebsocketConn(wsc)
+	t.Cleanup(func() { conn.Close() })
+
+	w := &WS{Conn: conn, t: t, events: make(chan *client.Response, 256)}
+	conn.On("*", func(r *client.Response) {
+		select {
+		case w.events <- r:
+		default:
+			t.Errorf("apiroutertest: too many unread events")
+		}
+	})
+	return w
+}
+
+// Call performs a request on the connection, collecting progress reports.
+func (w *WS) Call(path, verb string, params any) *WSResult {
+	w.t.Helper()
+
+	res := &WSResult{}
+	var lk sync.Mutex
+	ctx := client.WithProgress(context.Background(), func(data json.RawMessage) {
+		lk.Lock()
+		defer lk.Unlock()
+		res.Progress = append(res.Progress, data)
+	})
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	r, err := w.Conn.Call(ctx, path, verb, params)
+	lk.Lock()
+	defer lk.Unlock()
+	res.Response, res.Err = r, err
+	return res
+}
+
+// NextEvent returns the next message received on the connection that is not a
+// response, or nil if none was received within timeout.
+func (w *WS) NextEvent(timeout time.Duration) *client.Response {
+	select {
+	case r := <-w.events:
+		return r
+	case <-time.After(timeout):
+		return nil
+	}
+}
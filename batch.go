@@ -0,0 +1,218 @@
+package apirouter
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/KarpelesLab/pjson"
+)
+
+// BatchMaxRequests is the maximum number of requests accepted in a single @batch call.
+var BatchMaxRequests = 50
+
+// batchEntry is one request of a batch and its result.
+type batchEntry struct {
+	req  map[string]any // childRequest-shaped: path, verb, params, query_id
+	deps []int
+	res  *Response
+	data any // response data as json values, for references
+	done chan struct{}
+}
+
+// batch implements the @batch special path. It must be called with POST and takes the
+// following parameters:
+//
+//	{
+//		"requests": [
+//			{"path": "User:me", "query_id": "me"},
+//			{"path": "Order", "params": {"user": {"$ref": "0.id"}}}
+//		],
+//		"parallel": true
+//	}
+//
+// Each request runs as a child of the batch request, including request hooks. A value
+// {"$ref": "<index>.<path>"} in params is replaced with the value at path in the data of
+// the response to an earlier request of the batch. If parallel is true, requests run
+// concurrently, except for requests waiting on the requests they reference.
+//
+// The result is an array with the response to each request, in the same order.
+func (c *Context) batch() (any, error) {
+	if c.verb != "POST" {
+		return nil, ErrMethodNotAllowed("error_method_not_allowed", "@batch requires POST")
+	}
+	list, ok := c.GetParam("requests").([]any)
+	if !ok {
+		return nil, ErrBadRequest("error_missing_requests", "parameter requests is required")
+	}
+	if len(list) > BatchMaxRequests {
+		return nil, ErrBadRequest("error_batch_too_large", "a batch can contain at most %d requests", BatchMaxRequests)
+	}
+	parallel, _ := GetParam[bool](c, "parallel")
+
+	entries := make([]*batchEntry, len(list))
+	for i, v := range list {
+		req, ok := v.(map[string]any)
+		if !ok {
+			return nil, ErrBadRequest("error_bad_request", "request %d is not an object", i)
+		}
+		e := &batchEntry{req: req, done: make(chan struct{})}
+		if err := batchRefs(req["params"], i, &e.deps); err != nil {
+			return nil, err
+		}
+		entries[i] = e
+	}
+
+	// forward progress, identified by the request's query_id
+	sink := c.rsink
+	if !parallel {
+		for _, e := range entries {
+			c.batchRun(e, entries, sink)
+		}
+	} else {
+		if sink != nil {
+			// sinks are not required to support concurrent use
+			sink = &syncSink{sink: sink}
+		}
+		var wg sync.WaitGroup
+		for _, e := range entries {
+			wg.Add(1)
+			go func(e *batchEntry) {
+				defer wg.Done()
+				for _, d := range e.deps {
+					<-entries[d].done
+				}
+				c.batchRun(e, entries, sink)
+			}(e)
+		}
+		wg.Wait()
+	}
+
+	res := make([]any, len(entries))
+	for i, e := range entries {
+		res[i] = e.res.getResponseData()
+	}
+	return res, nil
+}
+
+// batchRun runs one entry of a batch, sending its progress to sink if not nil.
+func (c *Context) batchRun(e *batchEntry, entries []*batchEntry, sink ResponseSink) {
+	defer close(e.done)
+
+	e.res = c.batchCall(e, entries, sink)
+	if e.res.Result != "success" {
+		return
+	}
+	// keep data as json values so it can be referenced by later requests
+	if buf, err := pjson.MarshalContext(e.res.getJsonCtx(), e.res.Data); err == nil {
+		pjson.Unmarshal(buf, &e.data)
+	}
+}
+
+func (c *Context) batchCall(e *batchEntry, entries []*batchEntry, sink ResponseSink) *Response {
+	buf, err := pjson.Marshal(e.req)
+	if err != nil {
+		return c.errorResponse(err)
+	}
+	sub, err := NewChild(c, buf, "application/json")
+	if err != nil {
+		return sub.errorResponse(ErrBadRequest("error_bad_request", "%s", err))
+	}
+	if sub.path == "_websocket" || sub.path == "@batch" {
+		return sub.errorResponse(ErrBadRequest("error_bad_request", "%s cannot be called in a batch", sub.path))
+	}
+	for _, d := range e.deps {
+		if entries[d].res.Result != "success" {
+			return sub.errorResponse(ErrBadRequest("error_batch_dependency", "request %d failed", d))
+		}
+	}
+	if len(e.deps) > 0 {
+		sub.params, _ = batchResolve(sub.params, entries).(map[string]any)
+	}
+	if sink != nil {
+		sub.SetResponseSink(sink)
+	}
+	res, _ := sub.Response()
+	return res
+}
+
+// batchRef returns the reference in v if it is a {"$ref": "..."} object.
+func batchRef(v any) (string, bool) {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	ref, ok := m["$ref"].(string)
+	return ref, ok
+}
+
+// batchRefs lists the requests referenced in v by request n.
+func batchRefs(v any, n int, deps *[]int) error {
+	if ref, ok := batchRef(v); ok {
+		idx, _, _ := strings.Cut(ref, ".")
+		i, err := strconv.Atoi(idx)
+		if err != nil || i < 0 || i >= n {
+			return ErrBadRequest("error_bad_reference", "request %d has invalid reference %s", n, ref)
+		}
+		*deps = append(*deps, i)
+		return nil
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, sub := range v {
+			if err := batchRefs(sub, n, deps); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, sub := range v {
+			if err := batchRefs(sub, n, deps); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// batchResolve returns v with references replaced by their values.
+func batchResolve(v any, entries []*batchEntry) any {
+	if ref, ok := batchRef(v); ok {
+		idx, p, _ := strings.Cut(ref, ".")
+		i, _ := strconv.Atoi(idx)
+		res := entries[i].data
+		if p == "" {
+			return res
+		}
+		for _, k := range strings.Split(p, ".") {
+			switch r := res.(type) {
+			case map[string]any:
+				res = r[k]
+			case []any:
+				n, err := strconv.Atoi(k)
+				if err != nil || n < 0 || n >= len(r) {
+					return nil
+				}
+				res = r[n]
+			default:
+				return nil
+			}
+		}
+		return res
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for k, sub := range v {
+			res[k] = batchResolve(sub, entries)
+		}
+		return res
+	case []any:
+		res := make([]any, len(v))
+		for k, sub := range v {
+			res[k] = batchResolve(sub, entries)
+		}
+		return res
+	default:
+		return v
+	}
+}
@@ -0,0 +1,218 @@
+package apirouter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+var batchRunning, batchMaxRunning atomic.Int32
+
+func init() {
+	apirouter.RegisterStatic("BatchTest:order", func(ctx context.Context) (any, error) {
+		return map[string]any{"id": "o1", "lines": []any{map[string]any{"sku": "s1"}, map[string]any{"sku": "s2"}}}, nil
+	})
+	apirouter.RegisterStatic("BatchTest:echo", func(ctx context.Context, in map[string]any) (any, error) {
+		return in, nil
+	})
+	apirouter.RegisterStatic("BatchTest:fail", func(ctx context.Context) (any, error) {
+		return nil, apirouter.ErrTeapot
+	})
+	apirouter.RegisterStatic("BatchTest:slow", func(ctx context.Context) (int32, error) {
+		n := batchRunning.Add(1)
+		defer batchRunning.Add(-1)
+		for {
+			m := batchMaxRunning.Load()
+			if n <= m || batchMaxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return n, nil
+	})
+	apirouter.RegisterStatic("BatchTest:progress", func(ctx context.Context) (string, error) {
+		for i := 0; i < 20; i++ {
+			apirouter.Progress(ctx, i)
+		}
+		return "done", nil
+	})
+}
+
+type batchResult struct {
+	Result  string          `json:"result"`
+	Token   string          `json:"token"`
+	Data    json.RawMessage `json:"data"`
+	QueryId any             `json:"query_id"`
+}
+
+func TestBatch(t *testing.T) {
+	order := map[string]any{"path": "BatchTest:order"}
+	tests := []struct {
+		name     string
+		requests []any
+		want     []string // expected result or error token of each request, then data if any
+	}{
+		{
+			"refs",
+			[]any{order, map[string]any{"path": "BatchTest:echo", "verb": "POST", "params": map[string]any{
+				"order": map[string]any{"$ref": "0.id"},
+				"sku":   map[string]any{"$ref": "0.lines.1.sku"},
+				"all":   []any{map[string]any{"$ref": "0"}},
+				"bad":   map[string]any{"$ref": "0.lines.9"},
+			}}},
+			[]string{"success", `success {"all":[{"id":"o1","lines":[{"sku":"s1"},{"sku":"s2"}]}],"bad":null,"order":"o1","sku":"s2"}`},
+		},
+		{
+			"failed dependency",
+			[]any{map[string]any{"path": "BatchTest:fail"}, map[string]any{"path": "BatchTest:echo", "params": map[string]any{"v": map[string]any{"$ref": "0.id"}}}},
+			[]string{"error_teapot", "error_batch_dependency"},
+		},
+		{
+			"nested batch",
+			[]any{map[string]any{"path": "@batch", "verb": "POST"}, map[string]any{"path": "_websocket"}},
+			[]string{"error_bad_request", "error_bad_request"},
+		},
+		{
+			"not found",
+			[]any{map[string]any{"path": "BatchTest:missing"}, order},
+			[]string{"error_not_found", "success"},
+		},
+	}
+	for _, tt := range tests {
+		for _, parallel := range []bool{false, true} {
+			t.Run(tt.name+map[bool]string{false: "", true: " parallel"}[parallel], func(t *testing.T) {
+				var res []batchResult
+				apiroutertest.Call(t, "@batch", "POST", map[string]any{"requests": tt.requests, "parallel": parallel}).ExpectSuccess().Decode(&res)
+				if len(res) != len(tt.want) {
+					t.Fatalf("expected %d responses, got %d", len(tt.want), len(res))
+				}
+				for i, r := range res {
+					want, data, _ := strings.Cut(tt.want[i], " ")
+					got := r.Result
+					if r.Result == "error" {
+						got = r.Token
+					}
+					if got != want {
+						t.Errorf("request %d: expected %s, got %s", i, want, got)
+					}
+					if data != "" && string(r.Data) != data {
+						t.Errorf("request %d: expected data %s, got %s", i, data, r.Data)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	requests := func(n int) []any {
+		res := make([]any, n)
+		for i := range res {
+			res[i] = map[string]any{"path": "BatchTest:order"}
+		}
+		return res
+	}
+	tests := []struct {
+		name   string
+		verb   string
+		params any
+		token  string
+		code   int
+	}{
+		{"get", "GET", map[string]any{"requests": requests(1)}, "error_method_not_allowed", 405},
+		{"missing requests", "POST", map[string]any{}, "error_missing_requests", 400},
+		{"not an object", "POST", map[string]any{"requests": []any{"BatchTest:order"}}, "error_bad_request", 400},
+		{"too large", "POST", map[string]any{"requests": requests(apirouter.BatchMaxRequests + 1)}, "error_batch_too_large", 400},
+		{"self reference", "POST", map[string]any{"requests": []any{map[string]any{"path": "BatchTest:echo", "params": map[string]any{"v": map[string]any{"$ref": "0.id"}}}}}, "error_bad_reference", 400},
+		{"forward reference", "POST", map[string]any{"requests": []any{map[string]any{"path": "BatchTest:echo", "params": map[string]any{"v": map[string]any{"$ref": "1"}}}, map[string]any{"path": "BatchTest:order"}}}, "error_bad_reference", 400},
+		{"malformed reference", "POST", map[string]any{"requests": []any{map[string]any{"path": "BatchTest:order"}, map[string]any{"path": "BatchTest:echo", "params": map[string]any{"v": map[string]any{"$ref": "x.id"}}}}}, "error_bad_reference", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiroutertest.Call(t, "@batch", tt.verb, tt.params).ExpectError(tt.token).ExpectCode(tt.code)
+		})
+	}
+
+	// the limit itself is accepted
+	var res []batchResult
+	apiroutertest.Call(t, "@batch", "POST", map[string]any{"requests": requests(apirouter.BatchMaxRequests)}).ExpectSuccess().Decode(&res)
+	if len(res) != apirouter.BatchMaxRequests {
+		t.Errorf("expected %d responses, got %d", apirouter.BatchMaxRequests, len(res))
+	}
+}
+
+func TestBatchParallel(t *testing.T) {
+	slow := map[string]any{"path": "BatchTest:slow"}
+	for _, parallel := range []bool{false, true} {
+		batchMaxRunning.Store(0)
+		var res []batchResult
+		apiroutertest.Call(t, "@batch", "POST", map[string]any{"requests": []any{slow, slow, slow, slow}, "parallel": parallel}).ExpectSuccess().Decode(&res)
+		for i, r := range res {
+			if r.Result != "success" {
+				t.Errorf("parallel=%v: request %d failed with %s", parallel, i, r.Token)
+			}
+		}
+		if n := batchMaxRunning.Load(); parallel && n < 2 {
+			t.Errorf("parallel requests did not run concurrently")
+		} else if !parallel && n != 1 {
+			t.Errorf("sequential requests ran concurrently (%d)", n)
+		}
+	}
+}
+
+// TestBatchParallelProgress checks that progress of parallel requests is sent to the
+// batch's sink one message at a time.
+func TestBatchParallelProgress(t *testing.T) {
+	var reqs []any
+	for i := 0; i < 4; i++ {
+		reqs = append(reqs, map[string]any{"path": "BatchTest:progress", "query_id": i})
+	}
+	body, _ := json.Marshal(map[string]any{"requests": reqs, "parallel": true})
+	req := httptest.NewRequest("POST", "/@batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	c, err := apirouter.NewHttp(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetCsrfValidated(true)
+	var buf bytes.Buffer
+	c.SetResponseSink(apirouter.EncoderSink(json.NewEncoder(&buf)))
+	res, err := c.Response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != "success" {
+		t.Fatalf("batch failed: %s", res.Error)
+	}
+
+	counts := make(map[float64]int)
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var msg batchResult
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatalf("corrupted progress stream: %s", err)
+		}
+		if msg.Result != "progress" {
+			t.Errorf("unexpected message %s", msg.Result)
+		}
+		id, _ := msg.QueryId.(float64)
+		counts[id]++
+	}
+	for i := 0; i < 4; i++ {
+		if counts[float64(i)] != 20 {
+			t.Errorf("request %d: expected 20 progress messages, got %d", i, counts[float64(i)])
+		}
+	}
+}
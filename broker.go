@@ -0,0 +1,284 @@
+package apirouter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/KarpelesLab/emitter"
+	"github.com/KarpelesLab/pjson"
+	"github.com/KarpelesLab/ringslice"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Broker distributes WebSocket events published with [SendWS] and [BroadcastWS].
+// The default broker is an in-memory ring buffer, which only reaches clients connected
+// to the local process. When running several API instances, a shared broker such as
+// [TCPBroker] can be installed with [SetBroker] so events reach every instance.
+type Broker interface {
+	// Publish sends data on the given channel to all instances sharing this broker,
+	// including the local one.
+	Publish(ctx context.Context, channel string, data any) error
+
+	// Reader returns a blocking reader positioned at the current end of the event
+	// stream. Events returned have Args set to []any{channel, data}, optionally followed
+	// by the event id as a string for brokers implementing [ReplayBroker].
+	Reader() (BrokerReader, error)
+}
+
+// ReplayBroker is implemented by brokers that can replay recent events to clients
+// resuming after a reconnection.
+type ReplayBroker interface {
+	Broker
+
+	// ReaderSince returns a blocking reader positioned right after the event with the
+	// given id. If that event is no longer available (or the id is unknown), the reader
+	// is positioned at the current end of the stream and gap is true.
+	ReaderSince(lastEventId string) (r BrokerReader, gap bool, err error)
+}
+
+// BrokerReader reads events received by a [Broker]. ReadOne blocks until an event
+// is available. Close may be called while ReadOne is blocked in another goroutine,
+// and should make it return, as readers are closed when clients disconnect.
+type BrokerReader interface {
+	ReadOne() (*emitter.Event, error)
+	Close() error
+}
+
+var (
+	wsBroker   Broker = must(NewMemoryBroker(4096))
+	wsBrokerLk sync.RWMutex
+)
+
+// SetBroker replaces the broker used for WebSocket events. Clients already connected
+// will keep reading from the previous broker until they disconnect, so this should
+// typically be called at startup.
+func SetBroker(b Broker) {
+	wsBrokerLk.Lock()
+	defer wsBrokerLk.Unlock()
+
+	wsBroker = b
+}
+
+// GetBroker returns the broker currently used for WebSocket events.
+func GetBroker() Broker {
+	wsBrokerLk.RLock()
+	defer wsBrokerLk.RUnlock()
+
+	return wsBroker
+}
+
+// MemoryBroker is a [Broker] that keeps events in a local ring buffer. It is the
+// default broker, and is also used by network brokers for local delivery.
+//
+// Each event is assigned a monotonic id of the form "<stream>-<seq>", where stream
+// identifies this buffer. The id is carried next to the data in the event's Args, and
+// is sent to clients as "event_id" so they can resume from it, see [ReplayBroker].
+type MemoryBroker struct {
+	q      *ringslice.Writer[*emitter.Event]
+	stream string
+	seq    uint64
+	wake   chan struct{} // closed and replaced on each Publish
+	lk     sync.Mutex
+}
+
+// NewMemoryBroker returns a new in-memory broker keeping up to size events.
+func NewMemoryBroker(size int64) (*MemoryBroker, error) {
+	q, err := ringslice.New[*emitter.Event](size)
+	if err != nil {
+		return nil, err
+	}
+	stream := make([]byte, 4)
+	if _, err := rand.Read(stream); err != nil {
+		return nil, err
+	}
+	return &MemoryBroker{q: q, stream: hex.EncodeToString(stream), wake: make(chan struct{})}, nil
+}
+
+// Publish appends an event to the ring buffer.
+func (b *MemoryBroker) Publish(ctx context.Context, channel string, data any) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	id := b.stream + "-" + strconv.FormatUint(b.seq+1, 10)
+	ev := &emitter.Event{
+		Context: ctx,
+		Topic:   "broadcast",
+		Args:    []any{channel, data, id},
+	}
+	_, err := b.q.Append(ev)
+	if err != nil {
+		return err
+	}
+	b.seq += 1
+	close(b.wake)
+	b.wake = make(chan struct{})
+	return nil
+}
+
+// ReaderSince returns a reader replaying events published after lastEventId.
+func (b *MemoryBroker) ReaderSince(lastEventId string) (BrokerReader, bool, error) {
+	stream, seqStr, _ := strings.Cut(lastEventId, "-")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || stream != b.stream {
+		// not one of our ids, maybe from another instance or before a restart
+		r, err := b.Reader()
+		return r, true, err
+	}
+
+	// prevent Publish while we position the reader
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	oldest := uint64(1)
+	if size := uint64(b.q.Size()); b.seq > size {
+		oldest = b.seq - size + 1
+	}
+	if seq > b.seq || seq+1 < oldest {
+		// events were evicted from the buffer (or id is in the future)
+		r, err := b.reader()
+		return r, true, err
+	}
+
+	r := b.q.Reader()
+	if r == nil {
+		return nil, false, io.ErrClosedPipe
+	}
+	// reader is positioned at the oldest event, skip the ones the client has seen
+	for n := seq + 1 - oldest; n > 0; n-- {
+		if _, err := r.ReadOne(); err != nil {
+			r.Close()
+			return nil, false, err
+		}
+	}
+	return newMemoryReader(b, r), false, nil
+}
+
+// Reader returns a blocking reader positioned at the ring buffer's edge.
+func (b *MemoryBroker) Reader() (BrokerReader, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	return b.reader()
+}
+
+// reader returns a reader at the ring buffer's edge. b.lk must be held.
+func (b *MemoryBroker) reader() (BrokerReader, error) {
+	r := b.q.Reader()
+	if r == nil {
+		// writer was closed
+		return nil, io.ErrClosedPipe
+	}
+	r.Reset()
+	return newMemoryReader(b, r), nil
+}
+
+// memoryReader is a blocking reader for a [MemoryBroker]. Unlike ringslice's blocking
+// readers, it can be closed while ReadOne is waiting for an event, which then returns
+// io.ErrClosedPipe. This lets clients release their reader as soon as they disconnect.
+type memoryReader struct {
+	b      *MemoryBroker
+	r      *ringslice.Reader[*emitter.Event] // non-blocking
+	lk     sync.Mutex                        // protects r
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMemoryReader(b *MemoryBroker, r *ringslice.Reader[*emitter.Event]) *memoryReader {
+	return &memoryReader{b: b, r: r, closed: make(chan struct{})}
+}
+
+// ReadOne returns the next event, waiting for one to be published if needed.
+func (r *memoryReader) ReadOne() (*emitter.Event, error) {
+	for {
+		// grab the wake channel before reading so a Publish in between is not missed
+		r.b.lk.Lock()
+		wake := r.b.wake
+		r.b.lk.Unlock()
+
+		ev, err := r.readOne()
+		if err != io.EOF {
+			return ev, err
+		}
+		select {
+		case <-wake:
+		case <-r.closed:
+			return nil, io.ErrClosedPipe
+		}
+	}
+}
+
+func (r *memoryReader) readOne() (*emitter.Event, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	select {
+	case <-r.closed:
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	return r.r.ReadOne()
+}
+
+// Reset positions the reader after the latest event, see [ringslice.ErrStaleReader].
+func (r *memoryReader) Reset() {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	r.r.Reset()
+}
+
+// Close releases the reader. It can be called concurrently with ReadOne.
+func (r *memoryReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.lk.Lock()
+		defer r.lk.Unlock()
+		r.r.Close()
+	})
+	return nil
+}
+
+// encodeEvent returns the data of ev encoded for a client with the given format ("json"
+// or "cbor"). If ev has an id, it is added to the encoded data as "event_id", see
+// [withEventId]. The encoded value is cached on ev and shared between clients.
+func encodeEvent(ev *emitter.Event, format string) ([]byte, error) {
+	var id string
+	if len(ev.Args) > 2 {
+		id, _ = ev.Args[2].(string)
+	}
+	switch format {
+	case "cbor":
+		return ev.EncodedArg(1, "cbor", func(v any) ([]byte, error) {
+			return withEventId[cbor.RawMessage](v, id, cbor.Marshal, cbor.Unmarshal)
+		})
+	default:
+		return ev.EncodedArg(1, "json", func(v any) ([]byte, error) {
+			return withEventId[pjson.RawMessage](v, id, pjson.Marshal, pjson.Unmarshal)
+		})
+	}
+}
+
+// withEventId encodes data with marshal and adds the event id to it. Objects receive an
+// "event_id" key, and other values (slices, scalars, etc) are wrapped as
+// {"event_id": id, "data": data}.
+func withEventId[R ~[]byte](data any, id string, marshal func(any) ([]byte, error), unmarshal func([]byte, any) error) ([]byte, error) {
+	buf, err := marshal(data)
+	if err != nil || id == "" {
+		return buf, err
+	}
+	idBuf, err := marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]R
+	if err := unmarshal(buf, &m); err != nil || m == nil {
+		return marshal(map[string]R{"event_id": R(idBuf), "data": R(buf)})
+	}
+	m["event_id"] = R(idBuf)
+	return marshal(m)
+}
@@ -0,0 +1,295 @@
+package apirouter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/pjson"
+)
+
+// brokerFrame is the newline-delimited JSON message exchanged between a TCPBroker and
+// a TCPBrokerHub.
+type brokerFrame struct {
+	Channel string           `json:"channel"`
+	Data    pjson.RawMessage `json:"data"`
+}
+
+// TCPBrokerHub is a minimal fan-out server for [TCPBroker]. Each frame received from a
+// connected broker is relayed to all connected brokers, including the sender.
+//
+// Example usage:
+//
+//	l, _ := net.Listen("tcp", ":7070")
+//	go apirouter.NewTCPBrokerHub().Serve(l)
+type TCPBrokerHub struct {
+	peers   map[*hubPeer]struct{}
+	peersLk sync.RWMutex
+	l       net.Listener
+	closed  bool
+}
+
+type hubPeer struct {
+	c net.Conn
+	q chan []byte
+}
+
+// NewTCPBrokerHub returns a new hub ready to serve connections.
+func NewTCPBrokerHub() *TCPBrokerHub {
+	return &TCPBrokerHub{peers: make(map[*hubPeer]struct{})}
+}
+
+// Serve accepts connections on l until the hub is closed or l fails.
+func (h *TCPBrokerHub) Serve(l net.Listener) error {
+	h.peersLk.Lock()
+	if h.closed {
+		h.peersLk.Unlock()
+		return net.ErrClosed
+	}
+	h.l = l
+	h.peersLk.Unlock()
+
+	defer l.Close()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go h.handle(c)
+	}
+}
+
+// Close stops the hub's listener and disconnects all peers.
+func (h *TCPBrokerHub) Close() error {
+	h.peersLk.Lock()
+	defer h.peersLk.Unlock()
+
+	h.closed = true
+	for p := range h.peers {
+		p.c.Close()
+	}
+	if h.l != nil {
+		return h.l.Close()
+	}
+	return nil
+}
+
+func (h *TCPBrokerHub) handle(c net.Conn) {
+	defer c.Close()
+
+	p := &hubPeer{c: c, q: make(chan []byte, 1024)}
+
+	h.peersLk.Lock()
+	if h.closed {
+		h.peersLk.Unlock()
+		return
+	}
+	h.peers[p] = struct{}{}
+	h.peersLk.Unlock()
+
+	defer func() {
+		h.peersLk.Lock()
+		defer h.peersLk.Unlock()
+		delete(h.peers, p)
+		close(p.q)
+	}()
+
+	go func() {
+		for buf := range p.q {
+			if _, err := c.Write(buf); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}()
+
+	s := bufio.NewScanner(c)
+	s.Buffer(make([]byte, 0, 64*1024), int(MaxJsonDataLength))
+	for s.Scan() {
+		line := s.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		buf := make([]byte, len(line)+1)
+		copy(buf, line)
+		buf[len(line)] = '\n'
+		h.relay(buf)
+	}
+}
+
+func (h *TCPBrokerHub) relay(buf []byte) {
+	h.peersLk.RLock()
+	defer h.peersLk.RUnlock()
+
+	for p := range h.peers {
+		select {
+		case p.q <- buf:
+		default:
+			// peer is not keeping up, disconnect it so it can resync
+			p.c.Close()
+		}
+	}
+}
+
+// TCPBroker is a [Broker] connected to a [TCPBrokerHub]. Events are published to the hub
+// and delivered to local clients when the hub relays them back. If the hub cannot be
+// reached, events are delivered locally only, and the connection is retried in the
+// background.
+type TCPBroker struct {
+	addr  string
+	local *MemoryBroker
+
+	c      net.Conn
+	cLk    sync.Mutex
+	wlk    sync.Mutex // write lock
+	closed chan struct{}
+	once   sync.Once
+}
+
+// DialTCPBroker connects to the hub at addr and returns a broker that can be installed
+// with [SetBroker]. The initial connection must succeed.
+func DialTCPBroker(addr string) (*TCPBroker, error) {
+	local, err := NewMemoryBroker(4096)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &TCPBroker{
+		addr:   addr,
+		local:  local,
+		c:      c,
+		closed: make(chan struct{}),
+	}
+	go b.run(c)
+	return b, nil
+}
+
+// Publish sends an event to the hub, or delivers it locally if the hub is unreachable.
+func (b *TCPBroker) Publish(ctx context.Context, channel string, data any) error {
+	js, err := pjson.MarshalContext(ctx, data)
+	if err != nil {
+		return err
+	}
+	frame, err := pjson.Marshal(&brokerFrame{Channel: channel, Data: js})
+	if err != nil {
+		return err
+	}
+	frame = append(frame, '\n')
+
+	c := b.conn()
+	if c != nil {
+		b.wlk.Lock()
+		_, err = c.Write(frame)
+		b.wlk.Unlock()
+		if err == nil {
+			return nil
+		}
+		c.Close()
+	}
+
+	// hub is down, at least reach local clients
+	return b.local.Publish(ctx, channel, data)
+}
+
+// Reader returns a reader for events received from the hub.
+func (b *TCPBroker) Reader() (BrokerReader, error) {
+	return b.local.Reader()
+}
+
+// ReaderSince returns a reader replaying events received since lastEventId.
+func (b *TCPBroker) ReaderSince(lastEventId string) (BrokerReader, bool, error) {
+	return b.local.ReaderSince(lastEventId)
+}
+
+// Close disconnects from the hub and stops reconnection attempts.
+func (b *TCPBroker) Close() error {
+	b.cLk.Lock()
+	defer b.cLk.Unlock()
+
+	b.once.Do(func() { close(b.closed) })
+	if b.c != nil {
+		return b.c.Close()
+	}
+	return nil
+}
+
+func (b *TCPBroker) conn() net.Conn {
+	b.cLk.Lock()
+	defer b.cLk.Unlock()
+	return b.c
+}
+
+// setConn stores c as the current connection. It returns false and closes c if the
+// broker was closed in the meantime.
+func (b *TCPBroker) setConn(c net.Conn) bool {
+	b.cLk.Lock()
+	defer b.cLk.Unlock()
+
+	select {
+	case <-b.closed:
+		if c != nil {
+			c.Close()
+		}
+		return false
+	default:
+	}
+	b.c = c
+	return true
+}
+
+// run reads frames from the hub, reconnecting as needed until the broker is closed.
+func (b *TCPBroker) run(c net.Conn) {
+	delay := 100 * time.Millisecond
+
+	for {
+		err := b.read(c)
+		c.Close()
+		b.setConn(nil)
+
+		for {
+			select {
+			case <-b.closed:
+				return
+			case <-time.After(delay):
+			}
+			c, err = net.Dial("tcp", b.addr)
+			if err == nil {
+				delay = 100 * time.Millisecond
+				break
+			}
+			log.Printf("failed to reconnect to broker hub %s: %s", b.addr, err)
+			delay = min(delay*2, 30*time.Second)
+		}
+		if !b.setConn(c) {
+			return
+		}
+	}
+}
+
+func (b *TCPBroker) read(c net.Conn) error {
+	s := bufio.NewScanner(c)
+	s.Buffer(make([]byte, 0, 64*1024), int(MaxJsonDataLength))
+	for s.Scan() {
+		var frame *brokerFrame
+		if err := pjson.Unmarshal(s.Bytes(), &frame); err != nil || frame == nil {
+			continue
+		}
+		var data any
+		if err := pjson.Unmarshal(frame.Data, &data); err != nil {
+			continue
+		}
+		b.local.Publish(context.Background(), frame.Channel, data)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return errors.New("broker hub closed the connection")
+}
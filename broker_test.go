@@ -0,0 +1,325 @@
+package apirouter_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+	"github.com/KarpelesLab/pjson"
+)
+
+type brokerPayload struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret,protect"`
+}
+
+// readEvent reads one event from r, failing the test if none arrives in time.
+func readEvent(t *testing.T, r apirouter.BrokerReader) (string, any) {
+	t.Helper()
+	type result struct {
+		args []any
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ev, err := r.ReadOne()
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		ch <- result{args: ev.Args}
+	}()
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			t.Fatalf("failed to read event: %s", res.err)
+		}
+		return res.args[0].(string), res.args[1]
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return "", nil
+}
+
+func TestMemoryBrokerConcurrent(t *testing.T) {
+	b, err := apirouter.NewMemoryBroker(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Publish(context.Background(), "ch", j)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r, err := b.Reader()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestMemoryBrokerReaderClose checks that closing a reader releases a blocked ReadOne.
+func TestMemoryBrokerReaderClose(t *testing.T) {
+	b, err := apirouter.NewMemoryBroker(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.ReadOne()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("expected io.ErrClosedPipe, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadOne still blocked after Close")
+	}
+	if _, err := r.ReadOne(); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected io.ErrClosedPipe after Close, got %v", err)
+	}
+}
+
+func TestTCPBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := apirouter.NewTCPBrokerHub()
+	go hub.Serve(l)
+	t.Cleanup(func() { hub.Close() })
+
+	var brokers []*apirouter.TCPBroker
+	var readers []apirouter.BrokerReader
+	for i := 0; i < 2; i++ {
+		b, err := apirouter.DialTCPBroker(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		r, err := b.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close() })
+		brokers = append(brokers, b)
+		readers = append(readers, r)
+	}
+
+	// the hub may not have registered both connections yet, retry until the second
+	// broker hears from the first
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := brokers[0].Publish(context.Background(), "sync", nil); err != nil {
+			t.Fatal(err)
+		}
+		if ch, _ := readEvent(t, readers[1]); ch == "sync" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("brokers never connected")
+		}
+	}
+	ctx := pjson.ContextPublic(context.Background())
+	if err := brokers[0].Publish(ctx, "orders", &brokerPayload{Name: "bob", Secret: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range readers {
+		ch, data := readEvent(t, r)
+		for ch == "sync" {
+			ch, data = readEvent(t, r)
+		}
+		if ch != "orders" {
+			t.Errorf("broker %d: expected channel orders, got %s", i, ch)
+		}
+		m, ok := data.(map[string]any)
+		if !ok {
+			t.Fatalf("broker %d: unexpected data %#v", i, data)
+		}
+		if m["name"] != "bob" {
+			t.Errorf("broker %d: expected name bob, got %v", i, m["name"])
+		}
+		if _, found := m["secret"]; found {
+			t.Errorf("broker %d: protected field was sent to the hub", i)
+		}
+	}
+
+	// once closed, events are still delivered locally
+	brokers[1].Close()
+	if err := brokers[1].Publish(context.Background(), "local", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if ch, data := readEvent(t, readers[1]); ch != "local" || data != "hello" {
+		t.Errorf("unexpected local event %s %v", ch, data)
+	}
+}
+
+// publishIds publishes the given payloads on channel and returns their event ids.
+func publishIds(t *testing.T, b *apirouter.MemoryBroker, channel string, payloads ...any) []string {
+	t.Helper()
+	r, err := b.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var ids []string
+	for _, p := range payloads {
+		if err := b.Publish(context.Background(), channel, p); err != nil {
+			t.Fatal(err)
+		}
+		ev, err := r.ReadOne()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ev.Args) < 3 {
+			t.Fatalf("event has no id: %v", ev.Args)
+		}
+		ids = append(ids, ev.Args[2].(string))
+	}
+	return ids
+}
+
+func TestMemoryBrokerReplay(t *testing.T) {
+	other, err := apirouter.NewMemoryBroker(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := publishIds(t, other, "ch", 1)[0]
+
+	tests := []struct {
+		name string
+		id   func(ids []string) string
+		gap  bool
+		want []any // expected replayed payloads
+	}{
+		{"in buffer", func(ids []string) string { return ids[3] }, false, []any{5, 6}},
+		{"oldest", func(ids []string) string { return ids[2] }, false, []any{4, 5, 6}},
+		{"latest", func(ids []string) string { return ids[5] }, false, nil},
+		{"evicted", func(ids []string) string { return ids[0] }, true, nil},
+		{"foreign stream", func(ids []string) string { return foreign }, true, nil},
+		{"malformed", func(ids []string) string { return "nope" }, true, nil},
+		{"future", func(ids []string) string { return ids[5][:len(ids[5])-1] + "7" }, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the buffer holds 4 events, so 1 and 2 are evicted
+			b, err := apirouter.NewMemoryBroker(4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := publishIds(t, b, "ch", 1, 2, 3, 4, 5, 6)
+
+			r, gap, err := b.ReaderSince(tt.id(ids))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if gap != tt.gap {
+				t.Errorf("expected gap=%v, got %v", tt.gap, gap)
+			}
+			// a marker event shows where the replay ends
+			b.Publish(context.Background(), "ch", "end")
+			for i := 0; ; i++ {
+				_, data := readEvent(t, r)
+				if data == "end" {
+					if i != len(tt.want) {
+						t.Errorf("expected %d replayed events, got %d", len(tt.want), i)
+					}
+					break
+				}
+				if i >= len(tt.want) || data != tt.want[i] {
+					t.Fatalf("unexpected replayed event %v", data)
+				}
+			}
+		})
+	}
+}
+
+func TestWSEventId(t *testing.T) {
+	b, err := apirouter.NewMemoryBroker(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := apirouter.GetBroker()
+	apirouter.SetBroker(b)
+	t.Cleanup(func() { apirouter.SetBroker(prev) })
+
+	ws := apiroutertest.NewWS(t, apiroutertest.WithListen("replay"))
+	// the connection starts reading events in the background, wait until it does
+	for {
+		apirouter.SendWS(context.Background(), "replay", "sync")
+		if ws.NextEvent(100*time.Millisecond) != nil {
+			break
+		}
+	}
+	payloads := []any{
+		map[string]any{"result": "event", "data": "map"},
+		&brokerPayload{Name: "struct"},
+		[]string{"slice"},
+		"scalar",
+	}
+	var ids []string
+	for _, p := range payloads {
+		if err := apirouter.SendWS(context.Background(), "replay", p); err != nil {
+			t.Fatal(err)
+		}
+		ev := ws.NextEvent(2 * time.Second)
+		for ev != nil && strings.Contains(string(ev.Raw), `"sync"`) {
+			ev = ws.NextEvent(2 * time.Second)
+		}
+		if ev == nil {
+			t.Fatalf("event %v not received", p)
+		}
+		var msg struct {
+			EventId string `json:"event_id"`
+		}
+		if err := json.Unmarshal(ev.Raw, &msg); err != nil || msg.EventId == "" {
+			t.Fatalf("event %s has no event_id", ev.Raw)
+		}
+		ids = append(ids, msg.EventId)
+	}
+
+	// reconnecting after the second event replays the last two
+	ws = apiroutertest.NewWS(t, apiroutertest.WithListen("replay"), apiroutertest.WithHeader("Last-Event-ID", ids[1]))
+	for _, want := range []string{`{"data":["slice"],"event_id":"` + ids[2] + `"}`, `{"data":"scalar","event_id":"` + ids[3] + `"}`} {
+		ev := ws.NextEvent(2 * time.Second)
+		if ev == nil {
+			t.Fatal("replayed event not received")
+		}
+		if string(ev.Raw) != want {
+			t.Errorf("expected %s, got %s", want, ev.Raw)
+		}
+	}
+}
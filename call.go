@@ -10,6 +10,11 @@ import (
 
 func (c *Context) Call() (any, error) {
 	p := c.path
+	if c.verb != "OPTIONS" {
+		if err := c.checkRateLimit(""); err != nil {
+			return nil, err
+		}
+	}
 	if len(p) >= 1 && p[0] == '@' {
 		return c.CallSpecial()
 	}
@@ -43,6 +48,11 @@ func (c *Context) Call() (any, error) {
 			// starts with A-Z: this is likely a class name
 			v := r.Child(s)
 			if v != nil {
+				if !corsReq {
+					if err := c.checkRoute(v.String()); err != nil {
+						return nil, err
+					}
+				}
 				r = v
 				obj = nil
 				continue
@@ -69,6 +79,10 @@ func (c *Context) Call() (any, error) {
 			continue
 		}
 
+		if err := c.checkRoute(r.String() + ".fetch"); err != nil {
+			return nil, err
+		}
+
 		var res any
 		var err error
 		if get.IsStringArg(0) {
@@ -90,6 +104,13 @@ func (c *Context) Call() (any, error) {
 			c.flags["raw"] = true
 			return nil, &optionsResponder{[]string{"GET", "POST", "HEAD", "OPTIONS"}}
 		}
+		if p == "" {
+			// statics registered on the root, such as ":ping", are held by a child
+			// with an empty name
+			if ch := r.Child(""); ch != nil {
+				r = ch
+			}
+		}
 		// ok we need to call a static method
 		meth := r.Static(m)
 		if meth == nil {
@@ -97,6 +118,9 @@ func (c *Context) Call() (any, error) {
 		}
 		switch c.verb {
 		case "HEAD", "GET", "POST":
+			if err := c.checkRoute(r.String() + ":" + m); err != nil {
+				return nil, err
+			}
 			return meth.CallArg(c, c.params)
 		default:
 			return nil, webutil.HttpError(http.StatusMethodNotAllowed)
@@ -113,6 +137,9 @@ func (c *Context) Call() (any, error) {
 			return obj, nil
 		case "PATCH": // Update
 			if res, ok := obj.(Updatable); ok {
+				if err := c.checkRoute(r.String() + ".update"); err != nil {
+					return nil, err
+				}
 				err := res.ApiUpdate(c)
 				if err != nil {
 					return nil, err
@@ -122,6 +149,9 @@ func (c *Context) Call() (any, error) {
 			return nil, webutil.HttpError(http.StatusMethodNotAllowed)
 		case "DELETE": // Delete
 			if res, ok := obj.(Deletable); ok {
+				if err := c.checkRoute(r.String() + ".delete"); err != nil {
+					return nil, err
+				}
 				err := res.ApiDelete(c)
 				if err != nil {
 					return nil, err
@@ -147,16 +177,25 @@ func (c *Context) Call() (any, error) {
 	switch c.verb {
 	case "HEAD", "GET": // List
 		if list := r.Action.List; list != nil {
+			if err := c.checkRoute(r.String() + ".list"); err != nil {
+				return nil, err
+			}
 			return list.CallArg(c, c.params)
 		}
 		return nil, webutil.HttpError(http.StatusMethodNotAllowed)
 	case "POST": // Create
 		if create := r.Action.Create; create != nil {
+			if err := c.checkRoute(r.String() + ".create"); err != nil {
+				return nil, err
+			}
 			return create.CallArg(c, c.params)
 		}
 		return nil, webutil.HttpError(http.StatusMethodNotAllowed)
 	case "DELETE": // Clear
 		if clear := r.Action.Clear; clear != nil {
+			if err := c.checkRoute(r.String() + ".clear"); err != nil {
+				return nil, err
+			}
 			return clear.CallArg(c, c.params)
 		}
 		return nil, webutil.HttpError(http.StatusMethodNotAllowed)
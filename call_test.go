@@ -0,0 +1,47 @@
+package apirouter_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+func init() {
+	apirouter.RegisterStatic(":routeTestPing", func(ctx context.Context) (string, error) {
+		return "pong", nil
+	})
+	apirouter.RegisterStatic("RouteTest:ping", func(ctx context.Context) (string, error) {
+		return "nested pong", nil
+	})
+}
+
+func TestCallStatic(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string // expected result, empty for not found
+	}{
+		{"root", ":routeTestPing", "pong"},
+		{"root with slash", "/:routeTestPing", "pong"},
+		{"object", "RouteTest:ping", "nested pong"},
+		{"root missing", ":routeTestMissing", ""},
+		{"object on root", ":ping", ""},
+		{"root on object", "RouteTest:routeTestPing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := apiroutertest.Call(t, tt.path, "GET", nil)
+			if tt.want == "" {
+				res.ExpectError("error_not_found")
+				return
+			}
+			var got string
+			res.ExpectSuccess().Decode(&got)
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
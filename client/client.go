@@ -0,0 +1,144 @@
+// Package client implements clients for APIs served by apirouter, over HTTP,
+// WebSocket and UNIX sockets.
+//
+//	c := client.NewHTTP("https://example.com/_api")
+//	ctx = client.WithClient(ctx, c)
+//
+//	user, err := client.Do[*User](ctx, "User/123", "GET", nil)
+//
+// Errors returned by the API are decoded back into *apirouter.Error, with the original
+// Code, Token and Info.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/webutil"
+)
+
+// Caller is implemented by all clients of this package.
+type Caller interface {
+	// Call performs a request and returns its response. If the API returned an error,
+	// both the response and the error are returned.
+	Call(ctx context.Context, path, verb string, params any) (*Response, error)
+}
+
+// Default is the client used by [Do] when none was set with [WithClient].
+var Default Caller
+
+// ErrNoClient is returned by [Do] when no client is available.
+var ErrNoClient = errors.New("no api client available")
+
+// Response is a response received from the API.
+type Response struct {
+	Result       string          `json:"result"` // error|success|redirect|progress
+	Error        string          `json:"error,omitempty"`
+	Token        string          `json:"token,omitempty"`
+	ErrorInfo    any             `json:"error_info,omitempty"`
+	Code         int             `json:"code,omitempty"`
+	RequestId    string          `json:"request_id,omitempty"`
+	Time         float64         `json:"time"`
+	Data         json.RawMessage `json:"data"`
+	RedirectURL  string          `json:"redirect_url,omitempty"`
+	RedirectCode int             `json:"redirect_code,omitempty"`
+	QueryId      json.RawMessage `json:"query_id,omitempty"`
+	Raw          json.RawMessage `json:"-"` // full message as received
+}
+
+func parseResponse(raw []byte) (*Response, error) {
+	res := &Response{}
+	if err := json.Unmarshal(raw, res); err != nil {
+		return nil, err
+	}
+	res.Raw = raw
+	return res, nil
+}
+
+// Err returns the error represented by this response, as a *apirouter.Error, a
+// *webutil.Redirect for redirects, or nil on success.
+func (r *Response) Err() error {
+	switch r.Result {
+	case "error":
+		code := r.Code
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		return &apirouter.Error{Message: r.Error, Code: code, Token: r.Token, Info: r.ErrorInfo}
+	case "redirect":
+		u, err := url.Parse(r.RedirectURL)
+		if err != nil {
+			return err
+		}
+		code := r.RedirectCode
+		if code == 0 {
+			code = http.StatusFound
+		}
+		return &webutil.Redirect{URL: u, Code: code}
+	default:
+		return nil
+	}
+}
+
+// Decode decodes the response's data into v.
+func (r *Response) Decode(v any) error {
+	if len(r.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+type clientKey struct{}
+
+type progressKey struct{}
+
+// WithClient returns a context in which [Do] uses the given client.
+func WithClient(ctx context.Context, c Caller) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// FromContext returns the client set with [WithClient], or [Default].
+func FromContext(ctx context.Context) Caller {
+	if c, ok := ctx.Value(clientKey{}).(Caller); ok {
+		return c
+	}
+	return Default
+}
+
+// WithProgress returns a context in which calls report progress sent by the handler
+// (see apirouter.Progress) to fn. Progress is only available on persistent connections
+// (WebSocket and UNIX sockets).
+func WithProgress(ctx context.Context, fn func(data json.RawMessage)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFunc(ctx context.Context) func(json.RawMessage) {
+	fn, _ := ctx.Value(progressKey{}).(func(json.RawMessage))
+	return fn
+}
+
+// Do performs a request with the client from ctx (see [WithClient]) and decodes the
+// response data as T.
+func Do[T any](ctx context.Context, path, verb string, params any) (T, error) {
+	var res T
+	c := FromContext(ctx)
+	if c == nil {
+		return res, ErrNoClient
+	}
+	return DoWith[T](ctx, c, path, verb, params)
+}
+
+// DoWith performs a request with the given client and decodes the response data as T.
+func DoWith[T any](ctx context.Context, c Caller, path, verb string, params any) (T, error) {
+	var res T
+	r, err := c.Call(ctx, path, verb, params)
+	if err != nil {
+		return res, err
+	}
+	err = r.Decode(&res)
+	return res, err
+}
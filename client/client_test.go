@@ -0,0 +1,298 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+	"github.com/KarpelesLab/apirouter/client"
+	"github.com/coder/websocket"
+)
+
+var errClientTest = &apirouter.Error{Message: "I'm a teapot", Token: "error_client_test", Code: http.StatusTeapot}
+
+func init() {
+	apirouter.RegisterStatic("ClientTest:echo", func(ctx context.Context, in struct{ Value string }) (string, error) {
+		return in.Value, nil
+	})
+	apirouter.RegisterStatic("ClientTest:fail", func(ctx context.Context) (any, error) {
+		return nil, errClientTest
+	})
+	apirouter.RegisterStatic("ClientTest:progress", func(ctx context.Context) (string, error) {
+		for i := 1; i <= 3; i++ {
+			apirouter.Progress(ctx, i)
+		}
+		return "done", nil
+	})
+	apirouter.RegisterStatic("ClientTest:subscribe", func(ctx context.Context, in struct{ Channel string }) (any, error) {
+		var c *apirouter.Context
+		ctx.Value(&c)
+		c.SetListen(in.Channel, true)
+		return nil, nil
+	})
+	apirouter.RegisterStatic("ClientTest:notify", func(ctx context.Context, in struct{ Channel string }) (any, error) {
+		return nil, apirouter.SendWS(ctx, in.Channel, map[string]any{"result": "event", "data": in.Channel})
+	})
+	apirouter.RegisterStatic("ClientTest:large", func(ctx context.Context, in struct{ Size int }) (string, error) {
+		return strings.Repeat("x", in.Size), nil
+	})
+}
+
+func newHTTP(t *testing.T) *client.HTTP {
+	c := client.NewHTTP("http://localhost")
+	c.Client = apiroutertest.NewHTTPClient(t)
+	return c
+}
+
+func dialWebsocket(t *testing.T) *client.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wsc, _, err := websocket.Dial(ctx, "ws://localhost/_websocket", &websocket.DialOptions{HTTPClient: apiroutertest.NewHTTPClient(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.NewWebsocketConn(wsc)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// expectToken checks that err is an *apirouter.Error with the given token.
+func expectToken(t *testing.T, err error, token string) {
+	t.Helper()
+	var e *apirouter.Error
+	if !errors.As(err, &e) {
+		t.Fatalf("expected *apirouter.Error, got %v", err)
+	}
+	if e.Token != token {
+		t.Errorf("expected token %s, got %s", token, e.Token)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	c := newHTTP(t)
+	c.Header.Set("X-Test", "1")
+
+	tests := []struct {
+		name   string
+		path   string
+		verb   string
+		params any
+		want   string // expected data, empty for errors
+		token  string // expected error token
+		code   int
+	}{
+		{"get", "ClientTest:echo", "GET", map[string]any{"Value": "a b&c"}, "a b&c", "", 0},
+		{"post", "ClientTest:echo", "POST", map[string]any{"Value": "posted"}, "posted", "", 0},
+		{"default verb", "/ClientTest:echo", "", map[string]any{"Value": "x"}, "x", "", 0},
+		{"error", "ClientTest:fail", "GET", nil, "", "error_client_test", http.StatusTeapot},
+		{"not found", "ClientTest:missing", "GET", nil, "", "error_not_found", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := c.Call(context.Background(), tt.path, tt.verb, tt.params)
+			if tt.token != "" {
+				expectToken(t, err, tt.token)
+				var e *apirouter.Error
+				if errors.As(err, &e) && e.Code != tt.code {
+					t.Errorf("expected code %d, got %d", tt.code, e.Code)
+				}
+				if res == nil || res.Result != "error" {
+					t.Errorf("expected the error response to be returned, got %v", res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if err := res.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	if _, err := client.Do[string](context.Background(), "ClientTest:echo", "GET", nil); !errors.Is(err, client.ErrNoClient) {
+		t.Errorf("expected ErrNoClient, got %v", err)
+	}
+
+	ctx := client.WithClient(context.Background(), newHTTP(t))
+	got, err := client.Do[string](ctx, "ClientTest:echo", "GET", map[string]any{"Value": "do"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "do" {
+		t.Errorf("expected do, got %q", got)
+	}
+	_, err = client.Do[string](ctx, "ClientTest:fail", "GET", nil)
+	expectToken(t, err, errClientTest.Token)
+}
+
+func TestConn(t *testing.T) {
+	transports := []struct {
+		name string
+		dial func(t *testing.T) *client.Conn
+	}{
+		{"websocket", dialWebsocket},
+		{"unix", func(t *testing.T) *client.Conn {
+			name := filepath.Join(t.TempDir(), "api.sock")
+			l, err := apirouter.ListenJsonUnix(name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			c, err := client.DialUnix(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { c.Close() })
+			return c
+		}},
+		{"tcp", func(t *testing.T) *client.Conn {
+			l, err := apirouter.ListenJsonTCPInsecure("127.0.0.1:0", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			c, err := client.DialTCP(l.Addr().String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { c.Close() })
+			return c
+		}},
+	}
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			c := tr.dial(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			t.Run("multiplexed", func(t *testing.T) {
+				var wg sync.WaitGroup
+				for i := 0; i < 20; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						want := fmt.Sprintf("call %d", i)
+						got, err := client.DoWith[string](ctx, c, "ClientTest:echo", "POST", map[string]any{"Value": want})
+						if err != nil {
+							t.Error(err)
+						} else if got != want {
+							t.Errorf("expected %q, got %q", want, got)
+						}
+					}()
+				}
+				wg.Wait()
+			})
+
+			t.Run("error", func(t *testing.T) {
+				_, err := c.Call(ctx, "ClientTest:fail", "GET", nil)
+				expectToken(t, err, errClientTest.Token)
+			})
+
+			t.Run("progress", func(t *testing.T) {
+				var progress []string
+				pctx := client.WithProgress(ctx, func(data json.RawMessage) {
+					progress = append(progress, string(data))
+				})
+				got, err := client.DoWith[string](pctx, c, "ClientTest:progress", "GET", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != "done" || strings.Join(progress, ",") != "1,2,3" {
+					t.Errorf("unexpected result %q with progress %v", got, progress)
+				}
+			})
+
+			t.Run("events", func(t *testing.T) {
+				channel := "client-" + tr.name
+				events := make(chan string, 10)
+				c.On("event", func(r *client.Response) {
+					var data string
+					r.Decode(&data)
+					events <- data
+				})
+				if _, err := c.Call(ctx, "ClientTest:subscribe", "POST", map[string]any{"Channel": channel}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := c.Call(ctx, "ClientTest:notify", "POST", map[string]any{"Channel": channel}); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case data := <-events:
+					if data != channel {
+						t.Errorf("expected event on %s, got %s", channel, data)
+					}
+				case <-time.After(5 * time.Second):
+					t.Error("event not received")
+				}
+			})
+
+			t.Run("close", func(t *testing.T) {
+				c.Close()
+				select {
+				case <-c.Done():
+				case <-time.After(5 * time.Second):
+					t.Fatal("connection not closed")
+				}
+				if _, err := c.Call(ctx, "ClientTest:echo", "GET", nil); err == nil {
+					t.Error("expected call on a closed connection to fail")
+				}
+			})
+		})
+	}
+}
+
+func TestWebsocketReadLimit(t *testing.T) {
+	prev := client.MaxMessageSize
+	client.MaxMessageSize = 1024
+	t.Cleanup(func() { client.MaxMessageSize = prev })
+
+	// a real socket is used here: once the limit is hit both ends write close frames,
+	// which would block on an unbuffered in-memory pipe until the close handshake times out
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := apirouter.NewHttp(rw, req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.DialWebsocket(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/_websocket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if _, err := client.DoWith[string](ctx, c, "ClientTest:large", "GET", map[string]any{"Size": 512}); err != nil {
+		t.Fatalf("small response failed: %s", err)
+	}
+	if _, err := client.DoWith[string](ctx, c, "ClientTest:large", "GET", map[string]any{"Size": 4096}); err == nil {
+		t.Error("expected a response over the limit to fail")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("connection not closed after a message over the limit")
+	}
+}
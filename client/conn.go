@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+)
+
+// transport is a message based connection to the api.
+type transport interface {
+	read(ctx context.Context) ([]byte, error)
+	write(ctx context.Context, msg []byte) error
+	close() error
+}
+
+// Conn is a persistent connection to the api, over a WebSocket (see [DialWebsocket]) or a
+// socket (see [DialUnix]). Requests are multiplexed on the connection and matched to
+// their responses using query_id, so Call can be used concurrently.
+type Conn struct {
+	t        transport
+	ctx      context.Context
+	cancel   func()
+	qid      int64
+	pending  map[int64]*pendingCall
+	handlers map[string][]func(*Response)
+	err      error
+	lk       sync.Mutex
+	wlk      sync.Mutex // write lock
+}
+
+type pendingCall struct {
+	res      chan *Response
+	progress func(json.RawMessage)
+}
+
+func newConn(t transport) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		t:        t,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[int64]*pendingCall),
+		handlers: make(map[string][]func(*Response)),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Call implements [Caller]. Progress sent by the handler is reported to the function set
+// with [WithProgress], if any.
+func (c *Conn) Call(ctx context.Context, path, verb string, params any) (*Response, error) {
+	if verb == "" {
+		verb = "GET"
+	}
+	p := &pendingCall{res: make(chan *Response, 1), progress: progressFunc(ctx)}
+
+	c.lk.Lock()
+	if c.err != nil {
+		c.lk.Unlock()
+		return nil, c.err
+	}
+	c.qid += 1
+	id := c.qid
+	c.pending[id] = p
+	c.lk.Unlock()
+	defer c.release(id)
+
+	msg, err := json.Marshal(map[string]any{"path": path, "verb": verb, "params": params, "query_id": id})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-p.res:
+		return res, res.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.Err()
+	}
+}
+
+// On registers fn to be called for messages that are not responses to a call, such as
+// events sent with apirouter.SendWS or apirouter.BroadcastJson, based on their result
+// field ("event", "presence", "close", ...). Handlers registered with "*" receive all
+// such messages. Handlers run in the connection's read loop and must not block.
+//
+// Channel subscriptions are set by the server (see apirouter.Context.SetListen), so a
+// client typically calls an endpoint that subscribes it, then handles events with On.
+func (c *Conn) On(result string, fn func(*Response)) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.handlers[result] = append(c.handlers[result], fn)
+}
+
+// Done returns a channel that is closed once the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Err returns the reason the connection was closed, or nil if it is still open.
+func (c *Conn) Err() error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.err
+}
+
+// Close closes the connection. Pending calls fail with net.ErrClosed.
+func (c *Conn) Close() error {
+	c.fail(net.ErrClosed)
+	return c.t.close()
+}
+
+func (c *Conn) write(ctx context.Context, msg []byte) error {
+	c.wlk.Lock()
+	defer c.wlk.Unlock()
+
+	return c.t.write(ctx, msg)
+}
+
+func (c *Conn) release(id int64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	delete(c.pending, id)
+}
+
+func (c *Conn) fail(err error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	c.cancel()
+}
+
+func (c *Conn) readLoop() {
+	defer c.t.close()
+
+	for {
+		raw, err := c.t.read(c.ctx)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		res, err := parseResponse(raw)
+		if err != nil {
+			continue
+		}
+		c.dispatch(res)
+	}
+}
+
+func (c *Conn) dispatch(res *Response) {
+	var id int64
+	if len(res.QueryId) > 0 && string(res.QueryId) != "null" && json.Unmarshal(res.QueryId, &id) == nil {
+		c.lk.Lock()
+		p, ok := c.pending[id]
+		c.lk.Unlock()
+
+		if !ok {
+			// call was abandoned
+			return
+		}
+		if res.Result == "progress" {
+			if p.progress != nil {
+				p.progress(res.Data)
+			}
+			return
+		}
+		select {
+		case p.res <- res:
+		default:
+		}
+		return
+	}
+
+	c.lk.Lock()
+	var handlers []func(*Response)
+	handlers = append(handlers, c.handlers[res.Result]...)
+	handlers = append(handlers, c.handlers["*"]...)
+	c.lk.Unlock()
+
+	for _, fn := range handlers {
+		fn(res)
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/KarpelesLab/apirouter"
+)
+
+// HTTP is a client performing each request as an HTTP request.
+type HTTP struct {
+	BaseURL string       // url the api is served at, for example https://example.com/_api
+	Client  *http.Client // http client to use, http.DefaultClient if nil
+	Header  http.Header  // headers added to all requests, for example Authorization
+}
+
+// NewHTTP returns a new HTTP client for the api served at baseURL.
+func NewHTTP(baseURL string) *HTTP {
+	return &HTTP{BaseURL: baseURL, Header: make(http.Header)}
+}
+
+// Call implements [Caller]. Parameters are sent as a JSON body for POST, PATCH and PUT,
+// and in the "_" query parameter otherwise.
+func (h *HTTP) Call(ctx context.Context, path, verb string, params any) (*Response, error) {
+	if verb == "" {
+		verb = "GET"
+	}
+	target := strings.TrimRight(h.BaseURL, "/") + "/" + strings.TrimLeft(path, "/")
+
+	var body io.Reader
+	if params != nil {
+		js, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		switch verb {
+		case "POST", "PATCH", "PUT":
+			body = bytes.NewReader(js)
+		default:
+			target += "?_=" + url.QueryEscape(string(js))
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, verb, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	cl := h.Client
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := parseResponse(raw)
+	if err != nil || res.Result == "" {
+		// not an api response, for example an error from a proxy
+		return nil, &apirouter.Error{Message: resp.Status, Code: resp.StatusCode}
+	}
+	if res.Code == 0 && res.Result == "error" {
+		res.Code = resp.StatusCode
+	}
+	return res, res.Err()
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+type streamTransport struct {
+	c   net.Conn
+	dec *json.Decoder
+}
+
+// DialUnix connects to a UNIX socket created with apirouter.MakeJsonUnixListener.
+func DialUnix(socketName string) (*Conn, error) {
+	c, err := net.Dial("unix", socketName)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(c), nil
+}
+
+// DialTCP connects to a listener created with apirouter.ListenJsonTCP. If tlsConfig is
+// not nil, the connection uses TLS, with client certificates set in tlsConfig for mutual
+// TLS.
+func DialTCP(addr string, tlsConfig *tls.Config) (*Conn, error) {
+	var c net.Conn
+	var err error
+	if tlsConfig != nil {
+		c, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		c, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(c), nil
+}
+
+// NewStreamConn returns a [Conn] using an already established stream of JSON objects,
+// for example one end of a socket returned by apirouter.MakeJsonSocketFD.
+func NewStreamConn(c net.Conn) *Conn {
+	return newConn(&streamTransport{c: c, dec: json.NewDecoder(c)})
+}
+
+func (s *streamTransport) read(ctx context.Context) ([]byte, error) {
+	var msg json.RawMessage
+	if err := s.dec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *streamTransport) write(ctx context.Context, msg []byte) error {
+	if d, ok := ctx.Deadline(); ok {
+		s.c.SetWriteDeadline(d)
+		defer s.c.SetWriteDeadline(time.Time{})
+	}
+	_, err := s.c.Write(append(msg, '\n'))
+	return err
+}
+
+func (s *streamTransport) close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+
+	"github.com/coder/websocket"
+)
+
+// MaxMessageSize is the maximum size of a message read on a websocket connection. The
+// connection is closed if the server sends a larger message. It applies to connections
+// created after it is changed.
+var MaxMessageSize int64 = 32 << 20
+
+type wsTransport struct {
+	wsc *websocket.Conn
+}
+
+// NewWebsocketConn returns a Conn using an established websocket connection, for example
+// one dialed with custom options.
+func NewWebsocketConn(wsc *websocket.Conn) *Conn {
+	// responses can be larger than the default limit
+	wsc.SetReadLimit(MaxMessageSize)
+
+	return newConn(&wsTransport{wsc: wsc})
+}
+
+func (w *wsTransport) read(ctx context.Context) ([]byte, error) {
+	for {
+		mt, dat, err := w.wsc.Read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if mt == websocket.MessageText {
+			return dat, nil
+		}
+		// binary (cbor) messages are not expected as we only send json
+	}
+}
+
+func (w *wsTransport) write(ctx context.Context, msg []byte) error {
+	return w.wsc.Write(ctx, websocket.MessageText, msg)
+}
+
+func (w *wsTransport) close() error {
+	return w.wsc.Close(websocket.StatusNormalClosure, "")
+}
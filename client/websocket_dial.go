@@ -0,0 +1,20 @@
+//go:build !js
+
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/coder/websocket"
+)
+
+// DialWebsocket connects to the websocket endpoint of an api, for example
+// wss://example.com/_api/_websocket. The header can carry authentication, and may be nil.
+func DialWebsocket(ctx context.Context, u string, header http.Header) (*Conn, error) {
+	wsc, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		return nil, err
+	}
+	return NewWebsocketConn(wsc), nil
+}
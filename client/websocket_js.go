@@ -0,0 +1,25 @@
+//go:build js
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/coder/websocket"
+)
+
+// DialWebsocket connects to the websocket endpoint of an api, for example
+// wss://example.com/_api/_websocket. Browsers do not allow setting headers on websocket
+// connections, so header must be empty; authenticate with an @auth request instead.
+func DialWebsocket(ctx context.Context, u string, header http.Header) (*Conn, error) {
+	if len(header) > 0 {
+		return nil, errors.New("websocket headers are not supported in browsers")
+	}
+	wsc, _, err := websocket.Dial(ctx, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebsocketConn(wsc), nil
+}
@@ -0,0 +1,77 @@
+// Command apirouter-tsgen generates a TypeScript client for an apirouter API. It fetches
+// the schema from the @schema endpoint of a running server, which must be enabled by
+// setting apirouter.SchemaHook.
+//
+//	apirouter-tsgen -url http://localhost:8080/_api -o src/api.ts
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/client"
+)
+
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
+func main() {
+	var headers headerFlags
+	u := flag.String("url", "", "base url of the api, for example http://localhost:8080/_api")
+	output := flag.String("o", "-", "output file, - for stdout")
+	timeout := flag.Duration("timeout", 30*time.Second, "request timeout")
+	flag.Var(&headers, "H", "header sent with the request, for example \"Authorization: Bearer ...\" (repeatable)")
+	flag.Parse()
+
+	if *u == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.NewHTTP(*u)
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			log.Fatalf("invalid header %q", h)
+		}
+		c.Header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	schema, err := client.DoWith[*apirouter.Schema](ctx, c, "@schema", "GET", nil)
+	if err != nil {
+		log.Fatalf("failed to fetch schema: %s", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("failed to create output: %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := schema.WriteTypeScript(w); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write output: %s\n", err)
+		os.Exit(1)
+	}
+}
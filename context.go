@@ -3,6 +3,7 @@ package apirouter
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -41,22 +42,30 @@ type Context struct {
 	req    *http.Request       // can be nil
 	rw     http.ResponseWriter // can be nil
 	wsc    *websocket.Conn     // can be nil
+	ws     *wsState            // websocket client state, only on top level context
 	rsink  ResponseSink        // can be nil
 	params map[string]any      // parameters passed from POST?
 	get    map[string]any      // GET parameters (used for _ctx, etc)
 	flags  map[string]bool     // flags, such as "raw" or "pretty"
 	extra  map[string]any      // extra values in response
 	qid    any                 // client defined query id (optional)
+	chunk  *wsAttachmentChunk  // websocket attachment chunk, if this is not a request
 	start  time.Time
 
 	objects   map[string]any
 	inputJson pjson.RawMessage
 	user      any             // associated user object
+	expires   time.Time       // user session expiration, if any
+	scopes    []string        // granted scopes, nil if unrestricted
+	userLk    sync.RWMutex    // protects user, expires and scopes
 	csrfOk    bool            // is csrf token OK?
 	showProt  bool            // show protected fields?
 	accept    []string        // accepted mime types
 	events    map[string]bool // events we receive
 	eventsLk  sync.RWMutex
+	peer      *PeerCred            // UNIX socket peer, only on top level context
+	tls       *tls.ConnectionState // socket TLS state, only on top level context
+	rateLimit *RateLimitResult     // most restrictive rate limit of the request
 }
 
 // Request body size limits for different content types.
@@ -142,7 +151,8 @@ func NewChild(parent *Context, req []byte, contentType string) (*Context, error)
 		flags:    make(map[string]bool),
 		extra:    make(map[string]any),
 		reqid:    reqid,
-		user:     parent.user,
+		user:     parent.getUser(),
+		scopes:   parent.Scopes(),
 		csrfOk:   parent.csrfOk,
 		showProt: parent.showProt,
 		start:    time.Now(),
@@ -172,7 +182,7 @@ func (c *Context) Value(v any) any {
 		case "domain":
 			return c.GetDomain()
 		case "user_object":
-			return c.user
+			return c.getUser()
 		case "request_id":
 			return c.reqid
 		}
@@ -185,9 +195,62 @@ func (c *Context) Value(v any) any {
 // SetUser sets the user object for the associated context, which can be fetched with
 // GetUser[T](ctx). This method will typically be called in a RequestHook.
 func (c *Context) SetUser(user any) {
+	c.userLk.Lock()
+	defer c.userLk.Unlock()
+
 	c.user = user
 }
 
+// SetUserExpiry sets the time at which the user's session expires. On websocket
+// connections, the session is ended at that time according to WSSessionPolicy.
+func (c *Context) SetUserExpiry(t time.Time) {
+	c.userLk.Lock()
+	defer c.userLk.Unlock()
+
+	c.expires = t
+}
+
+// SetScopes restricts the request to the given scopes, see HasScope. This is typically
+// called by authentication hooks, for example for API keys limited to some operations.
+func (c *Context) SetScopes(scopes []string) {
+	c.userLk.Lock()
+	defer c.userLk.Unlock()
+
+	c.scopes = scopes
+}
+
+// Scopes returns the scopes set with SetScopes, or nil if the request is not restricted.
+func (c *Context) Scopes() []string {
+	c.userLk.RLock()
+	defer c.userLk.RUnlock()
+
+	return c.scopes
+}
+
+// HasScope returns true if the request is allowed the given scope, either because the
+// scope (or "*") was set with SetScopes, or because the request has no scope
+// restriction, as is the case for user sessions. It does not check that the request is
+// authenticated.
+func (c *Context) HasScope(scope string) bool {
+	scopes := c.Scopes()
+	if scopes == nil {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Context) getUser() any {
+	c.userLk.RLock()
+	defer c.userLk.RUnlock()
+
+	return c.user
+}
+
 // SetCsrfValidated is to be used in request hook to tell apirouter if the request came with
 // a valid and appropriate CSRF token.
 func (c *Context) SetCsrfValidated(ok bool) {
@@ -366,13 +429,11 @@ func (c *Context) SetFlag(flag string, val bool) {
 	c.flags[flag] = val
 }
 
-// RemoteAddr returns the remote address that made the request, if any is found
+// RemoteAddr returns the address of the client that made the request as a string, see
+// ClientIP. It returns "127.0.0.1" if the address is not known.
 func (c *Context) RemoteAddr() string {
-	if req := c.req; req != nil {
-		ipp := webutil.ParseIPPort(req.RemoteAddr)
-		if ipp != nil {
-			return ipp.IP.String()
-		}
+	if ip := c.ClientIP(); ip.IsValid() {
+		return ip.String()
 	}
 
 	return "127.0.0.1"
@@ -493,25 +554,35 @@ func (c *Context) SetHttp(rw http.ResponseWriter, req *http.Request) error {
 		}
 
 		body := c.req.Body
+		tooLarge := req.ContentLength > MaxJsonDataLength
 		if c.req.GetBody != nil {
 			body, err = c.req.GetBody()
 			if err != nil {
 				return err
 			}
-		} else if req.ContentLength > 0 && req.ContentLength < MaxJsonDataLength {
-			// store body for optional future use only up to maximum JSON data length
-			b, e := io.ReadAll(c.req.Body)
+		} else if req.ContentLength < MaxJsonDataLength {
+			// store body for optional future use (such as signature checks) only up to
+			// maximum JSON data length. Bodies of unknown length (chunked) are read up to
+			// that length to find out.
+			b, e := io.ReadAll(io.LimitReader(c.req.Body, MaxJsonDataLength))
 			if e != nil {
 				return e
 			}
-			c.req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil }
-			body, _ = c.req.GetBody()
+			if int64(len(b)) < MaxJsonDataLength {
+				c.req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil }
+				body, _ = c.req.GetBody()
+			} else {
+				// larger chunked body, keep streaming it without retaining it
+				tooLarge = true
+				c.req.Body = readCloser{io.MultiReader(bytes.NewReader(b), c.req.Body), c.req.Body}
+				body = c.req.Body
+			}
 		}
 
 		switch ct {
 		case "application/json":
 			// parse json
-			if req.ContentLength > MaxJsonDataLength {
+			if tooLarge {
 				// reject body
 				return ErrRequestEntityTooLarge
 			}
@@ -524,7 +595,7 @@ func (c *Context) SetHttp(rw http.ResponseWriter, req *http.Request) error {
 			return nil
 		case "application/cbor":
 			// parse cbor
-			if req.ContentLength > MaxJsonDataLength {
+			if tooLarge {
 				// reject body
 				return ErrRequestEntityTooLarge
 			}
@@ -633,10 +704,11 @@ func (c *Context) SetHttp(rw http.ResponseWriter, req *http.Request) error {
 }
 
 type childRequest struct {
-	Path    string           `json:"path" validator:"not_empty"`
-	Verb    string           `json:"verb"`
-	Params  map[string]any   `json:"params"`
-	QueryId pjson.RawMessage `json:"query_id"`
+	Path       string             `json:"path" validator:"not_empty"`
+	Verb       string             `json:"verb"`
+	Params     map[string]any     `json:"params"`
+	QueryId    pjson.RawMessage   `json:"query_id"`
+	Attachment *wsAttachmentChunk `json:"attachment,omitempty"` // websocket only, see wsAttachmentChunk
 }
 
 // SetBytes configures the Context with the given request sent raw with a content type
@@ -644,10 +716,19 @@ func (c *Context) SetBytes(req []byte, contentType string) error {
 	var in *childRequest
 	switch contentType {
 	case "application/cbor":
-		err := cbor.Unmarshal(req, &in)
+		// query_id can be any cbor value, which pjson.RawMessage cannot hold
+		var cin struct {
+			childRequest
+			QueryId any `json:"query_id"`
+		}
+		err := cbor.Unmarshal(req, &cin)
 		if err != nil {
 			return err
 		}
+		c.inputJson = req
+		err = c.setChildRequest(&cin.childRequest)
+		c.qid = cin.QueryId
+		return err
 	case "application/json":
 		fallthrough
 	default:
@@ -674,6 +755,11 @@ func (c *Context) SetDecoder(dec interface{ Decode(any) error }) error {
 }
 
 func (c *Context) setChildRequest(in *childRequest) error {
+	if in.Attachment != nil && in.Path == "" && c.wsc != nil {
+		c.chunk = in.Attachment
+		c.qid = in.QueryId
+		return nil
+	}
 	if in.Path == "" {
 		return errors.New("path is missing")
 	}
@@ -829,20 +915,29 @@ func (c *Context) SetListen(ev string, listen bool) {
 	c = c.goTop()
 
 	c.eventsLk.Lock()
-	defer c.eventsLk.Unlock()
-
 	if c.events == nil {
 		if !listen {
+			c.eventsLk.Unlock()
 			return
 		}
 		c.events = make(map[string]bool)
 	}
 
+	changed := c.events[ev] != listen
 	if listen {
 		c.events[ev] = true
 	} else {
 		delete(c.events, ev)
 	}
+	c.eventsLk.Unlock()
+
+	if changed {
+		if listen {
+			c.presenceJoin(ev)
+		} else {
+			c.presenceLeave(ev)
+		}
+	}
 }
 
 // GetListen returns a sorted list of all event channels this context is subscribed to.
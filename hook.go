@@ -13,7 +13,9 @@ type ResponseHook func(r *Response) error
 var (
 	// RequestHooks is a slice of hooks that will be executed before each request.
 	// Hooks are executed in order; if any hook returns an error, subsequent hooks
-	// are skipped and an error response is returned.
+	// are skipped and an error response is returned. On a websocket connection
+	// authenticated with @auth, the connection's user is restored after they run, see
+	// WSAuthHooks.
 	RequestHooks []RequestHook
 
 	// ResponseHooks is a slice of hooks that will be executed after generating a response.
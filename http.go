@@ -50,41 +50,40 @@ func (o *optionsResponder) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 }
 
 // GetDomainForRequest returns the domain name for an HTTP request.
-// It checks the Sec-Original-Host header first (for proxy scenarios),
-// then falls back to the Host header, stripping any port number.
+// It checks the Sec-Original-Host header first and the host forwarded by proxies, both
+// only from trusted proxies (see SetTrustedProxies), then falls back to the Host header,
+// stripping any port number.
 // Returns "_default" if no domain can be determined.
 func GetDomainForRequest(req *http.Request) string {
-	if originalHost := req.Header.Get("Sec-Original-Host"); originalHost != "" {
-		if host, _, _ := net.SplitHostPort(originalHost); host != "" {
-			return host
-		}
-		return originalHost
+	return domainForRequest(req, resolveForwarded(req))
+}
+
+func domainForRequest(req *http.Request, fwd *forwarded) string {
+	host := req.Host
+	if originalHost := req.Header.Get("Sec-Original-Host"); originalHost != "" && fwd.trusted {
+		host = originalHost
+	} else if fwd.host != "" {
+		host = fwd.host
 	}
-	if req.Host != "" {
-		host, _, _ := net.SplitHostPort(req.Host)
-		if host != "" {
-			return host
-		}
-		return req.Host
+	if host == "" {
+		// fallback
+		return "_default"
 	}
-
-	// fallback
-	return "_default"
+	if h, _, _ := net.SplitHostPort(host); h != "" {
+		return h
+	}
+	return host
 }
 
 // GetPrefixForRequest returns a URL that can be used to address the server directly.
 // It constructs the URL from the request's scheme, domain, and any path prefix.
-// It handles Sec-Original-Host and Sec-Access-Prefix headers for proxy scenarios.
+// It handles Sec-Original-Host and Sec-Access-Prefix headers set by trusted proxies, see
+// SetTrustedProxies.
 func GetPrefixForRequest(req *http.Request) *url.URL {
-	u := &url.URL{Host: GetDomainForRequest(req)}
-	// determine if we got https
-	if req.TLS == nil {
-		u.Scheme = "http"
-	} else {
-		u.Scheme = "https"
-	}
+	fwd := resolveForwarded(req)
+	u := &url.URL{Scheme: requestScheme(req, fwd), Host: domainForRequest(req, fwd)}
 	// check if we have a prefix
-	if pfx := req.Header.Get("Sec-Access-Prefix"); pfx != "" {
+	if pfx := req.Header.Get("Sec-Access-Prefix"); pfx != "" && fwd.trusted {
 		if !strings.HasPrefix(pfx, "/") {
 			pfx = "/" + pfx
 		}
@@ -14,3 +14,9 @@ type Updatable interface {
 type Deletable interface {
 	ApiDelete(ctx *Context) error
 }
+
+// RoleHolder is an interface that user objects can implement to be checked against
+// policies requiring roles, see [Policy].
+type RoleHolder interface {
+	HasRole(role string) bool
+}
@@ -0,0 +1,194 @@
+package apirouter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// JsonListener serves the API on a socket listener, see [ListenJsonUnix] and
+// [ListenJsonTCP].
+type JsonListener struct {
+	l     net.Listener
+	path  string // socket file, removed when the listener is closed
+	extra map[string]any
+
+	clients map[*jsonclient]struct{}
+	lk      sync.Mutex
+	closed  bool
+	total   uint64
+	conns   sync.WaitGroup // running connections
+}
+
+func newJsonListener(l net.Listener, extraObjects map[string]any) *JsonListener {
+	return &JsonListener{
+		l:       l,
+		extra:   extraObjects,
+		clients: make(map[*jsonclient]struct{}),
+	}
+}
+
+// serve accepts connections until the listener is closed. Errors caused by a lack of
+// resources, such as running out of file descriptors, are retried with a delay.
+func (l *JsonListener) serve() {
+	var delay time.Duration
+
+	for {
+		c, err := l.l.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			if isAcceptRetryable(err) {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("json socket: accept failed: %s, retrying in %s", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Printf("json socket: accept failed: %s", err)
+			return
+		}
+		delay = 0
+
+		cl := newJsonClient(c)
+		if !l.add(cl) {
+			c.Close()
+			return
+		}
+		go func() {
+			defer l.remove(cl)
+			cl.serve(l.extra)
+		}()
+	}
+}
+
+// isAcceptRetryable returns true if an accept error is expected to go away, such as
+// running out of file descriptors or a connection aborted before it was accepted.
+func isAcceptRetryable(err error) bool {
+	for _, e := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *JsonListener) add(cl *jsonclient) bool {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if l.closed {
+		return false
+	}
+	l.clients[cl] = struct{}{}
+	l.total += 1
+	l.conns.Add(1)
+	return true
+}
+
+func (l *JsonListener) remove(cl *jsonclient) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	delete(l.clients, cl)
+	l.conns.Done()
+}
+
+func (l *JsonListener) isClosed() bool {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	return l.closed
+}
+
+// Addr returns the listener's network address.
+func (l *JsonListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// ActiveConnections returns the number of currently open connections.
+func (l *JsonListener) ActiveConnections() int {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	return len(l.clients)
+}
+
+// TotalConnections returns the number of connections accepted since the listener started.
+func (l *JsonListener) TotalConnections() uint64 {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	return l.total
+}
+
+// stop closes the listener and removes the socket file. It returns the list of open
+// connections.
+func (l *JsonListener) stop() ([]*jsonclient, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	var err error
+	if !l.closed {
+		l.closed = true
+		err = l.l.Close()
+		if l.path != "" {
+			os.Remove(l.path)
+		}
+	}
+
+	res := make([]*jsonclient, 0, len(l.clients))
+	for cl := range l.clients {
+		res = append(res, cl)
+	}
+	return res, err
+}
+
+// Close stops accepting connections, removes the socket file and closes all open
+// connections immediately. Requests being processed still run, but their responses are
+// lost.
+func (l *JsonListener) Close() error {
+	clients, err := l.stop()
+	for _, cl := range clients {
+		cl.stopping.Store(true)
+		cl.c.Close()
+	}
+	return err
+}
+
+// Shutdown gracefully stops the listener: it stops accepting connections, removes the
+// socket file, stops reading new requests on open connections and waits for requests
+// being processed to complete before closing connections. If ctx is done first, the
+// remaining connections are closed and ctx's error is returned.
+func (l *JsonListener) Shutdown(ctx context.Context) error {
+	clients, err := l.stop()
+	for _, cl := range clients {
+		cl.stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		l.Close()
+		return ctx.Err()
+	}
+}
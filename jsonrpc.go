@@ -0,0 +1,221 @@
+package apirouter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/KarpelesLab/pjson"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCInvalidParams  = -32602
+	RPCServerError    = -32000 // used for all errors returned by the API
+)
+
+// JSONRPC is an HTTP handler serving the API with the JSON-RPC 2.0 protocol, for
+// clients that do not speak the apirouter envelope:
+//
+//	http.Handle("/rpc", apirouter.JSONRPC)
+//
+// The method is the path of the call, optionally prefixed with a verb ("User:search",
+// "User/123", "PATCH User/123"). The default verb is GET. Params must be an object. Errors
+// are returned with code RPCServerError and data holding the error token, info and HTTP
+// status. Batches and notifications are supported, batches are limited to
+// BatchMaxRequests requests.
+var JSONRPC = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "JSON-RPC requests must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxJsonDataLength))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) >= MaxJsonDataLength {
+		// do not parse nor let hooks check a truncated body
+		http.Error(rw, ErrRequestEntityTooLarge.Message, ErrRequestEntityTooLarge.Code)
+		return
+	}
+	// retain the body for request hooks, such as HMACVerifier
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+
+	res := rpcHandle(req.Context(), body, func(c *Context) {
+		c.req = req
+	}, nil)
+	if res == nil {
+		// notifications only
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	pjson.NewEncoder(rw).Encode(res)
+})
+
+type rpcRequest struct {
+	Jsonrpc string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  pjson.RawMessage `json:"params"`
+	Id      pjson.RawMessage `json:"id"` // absent for notifications
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// isJsonRPC returns true if msg is a JSON-RPC request or batch.
+func isJsonRPC(msg []byte) bool {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		return true
+	}
+	var v struct {
+		Jsonrpc string `json:"jsonrpc"`
+	}
+	return pjson.Unmarshal(msg, &v) == nil && v.Jsonrpc != ""
+}
+
+func rpcErrorResponse(id pjson.RawMessage, code int, msg string, data any) map[string]any {
+	if len(id) == 0 {
+		id = pjson.RawMessage("null")
+	}
+	return map[string]any{"jsonrpc": "2.0", "error": &rpcError{Code: code, Message: msg, Data: data}, "id": id}
+}
+
+// rpcHandle processes a JSON-RPC message, which is a single request or a batch, and
+// returns the response to send, or nil if there is nothing to send. setup is called on
+// the context of each call. If notify is not nil, progress is sent through it as
+// notifications.
+func rpcHandle(ctx context.Context, msg []byte, setup func(c *Context), notify func(any) error) any {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) == 0 || msg[0] != '[' {
+		if res := rpcCall(ctx, msg, setup, notify); res != nil {
+			return res
+		}
+		return nil
+	}
+
+	var batch []pjson.RawMessage
+	if err := pjson.Unmarshal(msg, &batch); err != nil {
+		return rpcErrorResponse(nil, RPCParseError, "Parse error", nil)
+	}
+	if len(batch) == 0 {
+		return rpcErrorResponse(nil, RPCInvalidRequest, "Invalid Request", nil)
+	}
+	if len(batch) > BatchMaxRequests {
+		// entries run concurrently, so batches are limited like @batch
+		return rpcErrorResponse(nil, RPCInvalidRequest, "Invalid Request", fmt.Sprintf("a batch can contain at most %d requests", BatchMaxRequests))
+	}
+
+	res := make([]map[string]any, len(batch))
+	var wg sync.WaitGroup
+	for i, sub := range batch {
+		wg.Add(1)
+		go func(i int, sub pjson.RawMessage) {
+			defer wg.Done()
+			res[i] = rpcCall(ctx, sub, setup, notify)
+		}(i, sub)
+	}
+	wg.Wait()
+
+	final := make([]map[string]any, 0, len(res))
+	for _, r := range res {
+		if r != nil {
+			final = append(final, r)
+		}
+	}
+	if len(final) == 0 {
+		return nil
+	}
+	return final
+}
+
+// rpcCall runs a single JSON-RPC request and returns its response, or nil for
+// notifications.
+func rpcCall(ctx context.Context, msg []byte, setup func(c *Context), notify func(any) error) map[string]any {
+	var in rpcRequest
+	if err := pjson.Unmarshal(msg, &in); err != nil {
+		if bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+			return rpcErrorResponse(nil, RPCParseError, "Parse error", nil)
+		}
+		return rpcErrorResponse(nil, RPCInvalidRequest, "Invalid Request", nil)
+	}
+	if in.Jsonrpc != "2.0" || in.Method == "" {
+		return rpcErrorResponse(in.Id, RPCInvalidRequest, "Invalid Request", nil)
+	}
+
+	verb, path := "GET", in.Method
+	if v, p, ok := strings.Cut(in.Method, " "); ok {
+		verb, path = strings.ToUpper(v), p
+	}
+	if path == "_websocket" {
+		return rpcErrorResponse(in.Id, RPCInvalidRequest, "Invalid Request", nil)
+	}
+
+	c := New(ctx, path, verb)
+	setup(c)
+	if len(in.Params) > 0 && string(in.Params) != "null" {
+		var params map[string]any
+		if err := pjson.Unmarshal(in.Params, &params); err != nil {
+			return rpcErrorResponse(in.Id, RPCInvalidParams, "Invalid params", "params must be an object")
+		}
+		c.params = params
+		c.inputJson = in.Params
+	}
+	if notify != nil && len(in.Id) > 0 {
+		c.SetResponseSink(&rpcProgressSink{id: in.Id, notify: notify})
+	}
+
+	res, _ := c.Response()
+	if len(in.Id) == 0 {
+		// notification
+		return nil
+	}
+
+	switch res.Result {
+	case "success":
+		data, err := pjson.MarshalContext(res.getJsonCtx(), res.Data)
+		if err != nil {
+			return rpcErrorResponse(in.Id, RPCServerError, err.Error(), map[string]any{"status": http.StatusInternalServerError})
+		}
+		return map[string]any{"jsonrpc": "2.0", "result": pjson.RawMessage(data), "id": in.Id}
+	case "redirect":
+		return rpcErrorResponse(in.Id, RPCServerError, "Redirect required", map[string]any{"status": res.RedirectCode, "redirect_url": res.RedirectURL})
+	default:
+		data := map[string]any{"status": res.Code}
+		if res.Token != "" {
+			data["token"] = res.Token
+		}
+		if res.ErrorInfo != nil {
+			data["info"] = res.ErrorInfo
+		}
+		return rpcErrorResponse(in.Id, RPCServerError, res.Error, data)
+	}
+}
+
+// rpcProgressSink sends progress as JSON-RPC notifications:
+//
+//	{"jsonrpc": "2.0", "method": "progress", "params": {"id": 1, "data": ...}}
+type rpcProgressSink struct {
+	id     pjson.RawMessage
+	notify func(any) error
+}
+
+func (s *rpcProgressSink) SendResponse(r *Response) error {
+	data, err := pjson.MarshalContext(r.getJsonCtx(), r.Data)
+	if err != nil {
+		return err
+	}
+	return s.notify(map[string]any{"jsonrpc": "2.0", "method": "progress", "params": map[string]any{"id": s.id, "data": pjson.RawMessage(data)}})
+}
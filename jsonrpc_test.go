@@ -0,0 +1,254 @@
+package apirouter_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+)
+
+var rpcTestCount atomic.Int64
+
+func init() {
+	apirouter.RegisterStatic("RPCTest:echo", func(ctx context.Context, in struct{ Value string }) (string, error) {
+		return in.Value, nil
+	})
+	apirouter.RegisterStatic("RPCTest:fail", func(ctx context.Context) (any, error) {
+		return nil, apirouter.ErrForbidden("error_rpc_test", "not allowed")
+	})
+	apirouter.RegisterStatic("RPCTest:count", func(ctx context.Context) (int64, error) {
+		return rpcTestCount.Add(1), nil
+	})
+	apirouter.RegisterStatic("RPCTest:progress", func(ctx context.Context) (string, error) {
+		for i := range 3 {
+			if err := apirouter.Progress(ctx, i); err != nil {
+				return "", err
+			}
+		}
+		return "done", nil
+	})
+}
+
+func rpcPost(t *testing.T, body string) (int, []byte) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/rpc", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+	apirouter.JSONRPC.ServeHTTP(rw, req)
+	return rw.Code, rw.Body.Bytes()
+}
+
+func rpcBatch(n int) string {
+	calls := make([]string, n)
+	for i := range calls {
+		calls[i] = fmt.Sprintf(`{"jsonrpc": "2.0", "method": "RPCTest:echo", "params": {"Value": "v%d"}, "id": %d}`, i, i)
+	}
+	return "[" + strings.Join(calls, ",") + "]"
+}
+
+func TestJSONRPCBatchLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		ok   bool
+	}{
+		{"single", 1, true},
+		{"at limit", apirouter.BatchMaxRequests, true},
+		{"over limit", apirouter.BatchMaxRequests + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := rpcPost(t, rpcBatch(tt.size))
+			if code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+			if !tt.ok {
+				var res struct {
+					Error struct {
+						Code int `json:"code"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(body, &res); err != nil {
+					t.Fatalf("expected a single error, got %s", body)
+				}
+				if res.Error.Code != apirouter.RPCInvalidRequest {
+					t.Errorf("expected code %d, got %d", apirouter.RPCInvalidRequest, res.Error.Code)
+				}
+				return
+			}
+			var res []struct {
+				Result string `json:"result"`
+				Id     int    `json:"id"`
+			}
+			if err := json.Unmarshal(body, &res); err != nil {
+				t.Fatalf("failed to decode %s: %s", body, err)
+			}
+			if len(res) != tt.size {
+				t.Fatalf("expected %d responses, got %d", tt.size, len(res))
+			}
+			for _, r := range res {
+				if r.Result != fmt.Sprintf("v%d", r.Id) {
+					t.Errorf("unexpected result %q for id %d", r.Result, r.Id)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONRPCTooLarge(t *testing.T) {
+	// the body is never parsed truncated
+	body := `{"jsonrpc": "2.0", "method": "RPCTest:echo", "id": 1}` + strings.Repeat(" ", int(apirouter.MaxJsonDataLength))
+	if code, _ := rpcPost(t, body); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", code)
+	}
+}
+
+func TestJSONRPCErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code int
+		data map[string]any
+	}{
+		{"parse error", `{"jsonrpc": "2.0", "method": `, apirouter.RPCParseError, nil},
+		{"not an object", `"RPCTest:echo"`, apirouter.RPCInvalidRequest, nil},
+		{"missing version", `{"method": "RPCTest:echo", "id": 1}`, apirouter.RPCInvalidRequest, nil},
+		{"missing method", `{"jsonrpc": "2.0", "id": 1}`, apirouter.RPCInvalidRequest, nil},
+		{"websocket", `{"jsonrpc": "2.0", "method": "_websocket", "id": 1}`, apirouter.RPCInvalidRequest, nil},
+		{"params not an object", `{"jsonrpc": "2.0", "method": "RPCTest:echo", "params": ["x"], "id": 1}`, apirouter.RPCInvalidParams, nil},
+		{"api error", `{"jsonrpc": "2.0", "method": "RPCTest:fail", "id": 1}`, apirouter.RPCServerError, map[string]any{"status": float64(http.StatusForbidden), "token": "error_rpc_test"}},
+		{"not found", `{"jsonrpc": "2.0", "method": "RPCTest:missing", "id": 1}`, apirouter.RPCServerError, map[string]any{"status": float64(http.StatusNotFound), "token": "error_not_found"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := rpcPost(t, tt.body)
+			if code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+			var res struct {
+				Error *struct {
+					Code int             `json:"code"`
+					Data json.RawMessage `json:"data"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(body, &res); err != nil || res.Error == nil {
+				t.Fatalf("expected an error, got %s", body)
+			}
+			if res.Error.Code != tt.code {
+				t.Errorf("expected code %d, got %d", tt.code, res.Error.Code)
+			}
+			if tt.data != nil {
+				var data map[string]any
+				json.Unmarshal(res.Error.Data, &data)
+				if !reflect.DeepEqual(data, tt.data) {
+					t.Errorf("expected data %v, got %s", tt.data, res.Error.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONRPCNotifications(t *testing.T) {
+	t.Run("single", func(t *testing.T) {
+		n := rpcTestCount.Load()
+		code, body := rpcPost(t, `{"jsonrpc": "2.0", "method": "RPCTest:count"}`)
+		if code != http.StatusNoContent || len(body) != 0 {
+			t.Errorf("expected an empty 204 response, got %d %s", code, body)
+		}
+		if rpcTestCount.Load() != n+1 {
+			t.Errorf("notification was not run")
+		}
+	})
+	t.Run("batch", func(t *testing.T) {
+		n := rpcTestCount.Load()
+		code, body := rpcPost(t, `[{"jsonrpc": "2.0", "method": "RPCTest:count"}, {"jsonrpc": "2.0", "method": "RPCTest:echo", "params": {"Value": "x"}, "id": 7}, {"jsonrpc": "2.0", "method": "RPCTest:fail"}]`)
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+		var res []struct {
+			Result string `json:"result"`
+			Id     int    `json:"id"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatalf("failed to decode %s: %s", body, err)
+		}
+		if len(res) != 1 || res[0].Id != 7 || res[0].Result != "x" {
+			t.Errorf("expected only the response to id 7, got %s", body)
+		}
+		if rpcTestCount.Load() != n+1 {
+			t.Errorf("notification was not run")
+		}
+	})
+	t.Run("batch of notifications", func(t *testing.T) {
+		code, body := rpcPost(t, `[{"jsonrpc": "2.0", "method": "RPCTest:count"}, {"jsonrpc": "2.0", "method": "RPCTest:count"}]`)
+		if code != http.StatusNoContent || len(body) != 0 {
+			t.Errorf("expected an empty 204 response, got %d %s", code, body)
+		}
+	})
+}
+
+// TestJSONRPCSocket checks JSON-RPC over a json socket, where progress is sent as
+// notifications and notifications receive no response.
+func TestJSONRPCSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := apirouter.ListenJsonUnix(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the notification to complete before other tests change hooks
+	defer l.Shutdown(context.Background())
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	// the notification must not produce anything, so the first line read is the
+	// response to the call sent after it
+	c.Write([]byte(`{"jsonrpc": "2.0", "method": "RPCTest:fail"}` + "\n"))
+	c.Write([]byte(`{"jsonrpc": "2.0", "method": "RPCTest:progress", "id": "p1"}` + "\n"))
+
+	type message struct {
+		Method string `json:"method"`
+		Params struct {
+			Id   string `json:"id"`
+			Data int    `json:"data"`
+		} `json:"params"`
+		Result string          `json:"result"`
+		Error  json.RawMessage `json:"error"`
+		Id     string          `json:"id"`
+	}
+	for i := 0; ; i++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			t.Fatalf("failed to decode %s: %s", line, err)
+		}
+		if msg.Method == "" {
+			if msg.Id != "p1" || msg.Result != "done" {
+				t.Fatalf("unexpected response %s", line)
+			}
+			if i != 3 {
+				t.Errorf("expected 3 progress notifications, got %d", i)
+			}
+			break
+		}
+		if msg.Method != "progress" || msg.Params.Id != "p1" || msg.Params.Data != i {
+			t.Errorf("unexpected notification %s", line)
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package apirouter
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/KarpelesLab/pjson"
+	"github.com/KarpelesLab/ringslice"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/google/uuid"
 )
 
@@ -24,7 +33,9 @@ var (
 //
 //	apirouter.BroadcastJson(ctx, map[string]any{"result": "event", "type": "update", "data": payload})
 //
-// Messages are sent asynchronously to all connected clients.
+// Messages are sent asynchronously to all connected clients, regardless of their
+// subscriptions. Socket clients also receive events sent with [SendWS] and [BroadcastWS]
+// like websocket clients, which should be preferred.
 func BroadcastJson(ctx context.Context, data any) error {
 	clients := listJsonClients()
 	for _, c := range clients {
@@ -44,18 +55,29 @@ func listJsonClients() []*jsonclient {
 	return res
 }
 
-// MakeJsonUnixListener creates a UNIX socket at the given path and starts listening for connections.
+// ListenJsonUnix creates a UNIX socket at the given path and starts listening for connections.
 // Each connection receives a JSON-RPC style interface where clients send requests like:
 //
 //	{"path": "Object:method", "verb": "GET", "params": {...}}
 //
+// Clients can switch a connection to CBOR by sending a 0x00 byte first. Messages in both
+// directions are then CBOR objects prefixed with their length as a 32 bits big endian value.
+//
 // The extraObjects map allows injecting additional objects into each request's context.
 // If socketName exceeds platform limits (104 chars on Darwin, 108 on Linux), a symlink
 // workaround is automatically applied.
-func MakeJsonUnixListener(socketName string, extraObjects map[string]any) error {
+//
+// The returned listener can be stopped with Close or Shutdown, which also remove the socket.
+// Options can restrict who can connect to the socket, see also [SocketHooks].
+func ListenJsonUnix(socketName string, extraObjects map[string]any, opts ...SocketOption) (*JsonListener, error) {
+	cfg := &socketConfig{uid: -1, gid: -1}
+	for _, o := range opts {
+		o(cfg)
+	}
+
 	socketName, err := filepath.Abs(socketName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// create a socket at path socketName
 	os.Remove(socketName)
@@ -64,10 +86,24 @@ func MakeJsonUnixListener(socketName string, extraObjects map[string]any) error
 	}
 	abs, err := filepath.Abs(socketName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dataDir := filepath.Dir(abs)
 
+	// bindName is where the socket is created
+	bindName := abs
+	if cfg.mode != 0 || cfg.uid != -1 || cfg.gid != -1 {
+		// create the socket in a private directory and only move it in place once its
+		// permissions are set, so it cannot be connected to in the meantime
+		tmpDir, err := os.MkdirTemp(dataDir, ".socket_tmp.")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmpDir)
+		bindName = filepath.Join(tmpDir, "s")
+	}
+	socketName = bindName
+
 	if len(socketName) >= 100 {
 		// there's a risk we are at the limit of what's acceptable (104 on ios, 108 on android), let's create a temp name
 		for {
@@ -90,7 +126,7 @@ func MakeJsonUnixListener(socketName string, extraObjects map[string]any) error
 				os.Chdir(dataDir)
 				err = os.Symlink(socketName, tp)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 			defer os.Remove(tp)
@@ -100,48 +136,183 @@ func MakeJsonUnixListener(socketName string, extraObjects map[string]any) error
 	}
 	s, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketName})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// TODO if there is an error make sure directory is writable, attempt to chdir to data dir if not?
+	if err := cfg.apply(bindName); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if bindName != abs {
+		if err := os.Rename(bindName, abs); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
 
-	go listenJsonSocket(s, extraObjects)
+	l := newJsonListener(s, extraObjects)
+	l.path = abs
+	go l.serve()
 
-	return nil
+	return l, nil
 }
 
-// listenJsonSocket listens to the given listener and instantiates a handler for each new connection.
-func listenJsonSocket(l net.Listener, extraObjects map[string]any) {
-	defer l.Close()
+// MakeJsonUnixListener is like [ListenJsonUnix], for callers that do not need to stop the
+// listener.
+func MakeJsonUnixListener(socketName string, extraObjects map[string]any, opts ...SocketOption) error {
+	_, err := ListenJsonUnix(socketName, extraObjects, opts...)
+	return err
+}
 
-	for {
-		c, err := l.Accept()
-		if err != nil {
-			log.Printf("listen failed: %s", err)
-			return
+// SocketOption configures the socket file created by [ListenJsonUnix].
+type SocketOption func(*socketConfig)
+
+type socketConfig struct {
+	mode     os.FileMode
+	uid, gid int
+}
+
+// WithSocketMode sets the permissions of the socket file. Connecting to a UNIX socket
+// requires write permission, so 0660 only allows the owner and group to connect. The
+// socket is only made available at its path once its mode and owner are set.
+func WithSocketMode(mode os.FileMode) SocketOption {
+	return func(c *socketConfig) { c.mode = mode }
+}
+
+// WithSocketOwner sets the owner and group of the socket file. A value of -1 leaves the
+// owner or group unchanged.
+func WithSocketOwner(uid, gid int) SocketOption {
+	return func(c *socketConfig) { c.uid, c.gid = uid, gid }
+}
+
+// apply sets the configured mode and owner on the socket file.
+func (c *socketConfig) apply(path string) error {
+	if c.mode != 0 {
+		if err := os.Chmod(path, c.mode); err != nil {
+			return err
+		}
+	}
+	if c.uid != -1 || c.gid != -1 {
+		if err := os.Chown(path, c.uid, c.gid); err != nil {
+			return err
 		}
-		go handleJsonClient(c, extraObjects)
 	}
+	return nil
 }
 
+// socketCborMode is sent by a client as the first byte of a connection to switch to
+// length-prefixed cbor frames instead of newline-delimited json.
+const socketCborMode = 0x00
+
+// SocketModeTimeout is the time allowed for socket clients to send the byte switching the
+// connection to CBOR. Connections where nothing was received by then use JSON, which lets
+// messages be sent to clients that have not sent anything yet.
+var SocketModeTimeout = time.Second
+
 type jsonclient struct {
-	c   net.Conn
-	enc *json.Encoder
-	wlk sync.Mutex // write lock
-	id  uuid.UUID
+	c        net.Conn
+	ctx      *Context      // connection context, parent of all requests
+	cbor     bool          // use length-prefixed cbor frames, set once modeSet is closed
+	modeOnce sync.Once     // see setMode
+	modeSet  chan struct{} // closed once the encoding is known
+	wlk      sync.Mutex    // write lock
+	id       uuid.UUID
+	inflight sync.WaitGroup // requests being processed
+	stopping atomic.Bool    // no longer reading requests, see stop
 }
 
+func newJsonClient(c net.Conn) *jsonclient {
+	return &jsonclient{
+		c:       c,
+		modeSet: make(chan struct{}),
+		id:      uuid.Must(uuid.NewRandom()),
+	}
+}
+
+// setMode sets the encoding of the connection unless it is already known, and returns
+// whether cbor is used.
+func (cl *jsonclient) setMode(cbor bool) bool {
+	cl.modeOnce.Do(func() {
+		cl.cbor = cbor
+		close(cl.modeSet)
+	})
+	return cl.cbor
+}
+
+// readMode reads the first byte of the connection if it selects cbor, and sets the
+// encoding. Nothing is consumed in json mode, as the first byte is part of a request.
+func (cl *jsonclient) readMode(br *bufio.Reader) error {
+	first, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+	if cl.setMode(first[0] == socketCborMode) && first[0] == socketCborMode {
+		br.Discard(1)
+	}
+	return nil
+}
+
+// Encode sends obj to the client. In json mode, protected fields are hidden.
 func (cl *jsonclient) Encode(obj any) error {
+	<-cl.modeSet
+	if cl.cbor {
+		buf, err := cbor.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		return cl.write(buf)
+	}
+	buf, err := pjson.MarshalContext(pjson.ContextPublic(context.Background()), obj)
+	if err != nil {
+		return err
+	}
+	return cl.write(append(buf, '\n'))
+}
+
+func (cl *jsonclient) SendResponse(r *Response) error {
+	<-cl.modeSet
+	buf, err := r.encode(cl.cbor)
+	if err != nil {
+		return err
+	}
+	return cl.write(buf)
+}
+
+// write sends an encoded message, prefixed with its length as a 32 bits big endian
+// value in cbor mode.
+func (cl *jsonclient) write(buf []byte) error {
 	cl.wlk.Lock()
 	defer cl.wlk.Unlock()
 
-	return cl.enc.Encode(obj)
+	if cl.cbor {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(buf)))
+		if _, err := cl.c.Write(hdr[:]); err != nil {
+			return err
+		}
+	}
+	_, err := cl.c.Write(buf)
+	return err
 }
 
-func (cl *jsonclient) SendResponse(r *Response) error {
-	return cl.Encode(r)
+// readFrame reads one length-prefixed frame.
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	ln := binary.BigEndian.Uint32(hdr[:])
+	if int64(ln) > MaxJsonDataLength {
+		return nil, ErrRequestEntityTooLarge
+	}
+	buf := make([]byte, ln)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
 }
 
 func (cl *jsonclient) run(obj *Context) {
+	defer cl.inflight.Done()
+
 	resp, _ := obj.Response()
 	err := cl.SendResponse(resp)
 	if err != nil {
@@ -150,6 +321,26 @@ func (cl *jsonclient) run(obj *Context) {
 	}
 }
 
+func (cl *jsonclient) runRPC(msg []byte, extraObjects map[string]any) {
+	defer cl.inflight.Done()
+
+	res := rpcHandle(cl.ctx, msg, func(obj *Context) {
+		for k, v := range extraObjects {
+			obj.SetObject(k, v)
+		}
+		obj.SetObject("@client", cl)
+		obj.SetUser(cl.ctx.getUser())
+		obj.SetScopes(cl.ctx.Scopes())
+	}, cl.Encode)
+	if res == nil {
+		return
+	}
+	if err := cl.Encode(res); err != nil {
+		log.Printf("failed to write response: %s", err)
+		cl.c.Close()
+	}
+}
+
 func (cl *jsonclient) register() {
 	jsonClientsLk.Lock()
 	defer jsonClientsLk.Unlock()
@@ -164,9 +355,88 @@ func (cl *jsonclient) deregister() {
 	delete(jsonClients, cl.id)
 }
 
+// listen sends the client events published on channels it is subscribed to, see
+// SetListen.
+func (cl *jsonclient) listen() {
+	r, err := GetBroker().Reader()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	// ReadOne blocks until an event is published, release the reader on disconnect
+	stop := context.AfterFunc(cl.ctx, func() { r.Close() })
+	defer stop()
+
+	for {
+		ev, err := r.ReadOne()
+		if cl.ctx.Err() != nil {
+			// connection closed
+			return
+		}
+		if errors.Is(err, ringslice.ErrStaleReader) {
+			// we fell behind the whole buffer
+			rr, ok := r.(interface{ Reset() })
+			if !ok {
+				cl.c.Close()
+				return
+			}
+			rr.Reset()
+			cl.Encode(map[string]any{"result": "gap"})
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if len(ev.Args) < 2 {
+			continue
+		}
+		channel, ok := ev.Args[0].(string)
+		if !ok || !cl.ctx.ListensFor(channel) {
+			continue
+		}
+		<-cl.modeSet
+		var buf []byte
+		if cl.cbor {
+			buf, err = encodeEvent(ev, "cbor")
+		} else {
+			buf, err = encodeEvent(ev, "json")
+			// the encoded value is shared with other clients, copy it
+			buf = append(buf[:len(buf):len(buf)], '\n')
+		}
+		if err != nil {
+			continue
+		}
+		if err := cl.write(buf); err != nil {
+			cl.c.Close()
+			return
+		}
+	}
+}
+
+// stop makes the client stop reading requests. The connection is closed once requests
+// being processed are done. An error is returned if a pending read could not be
+// interrupted because the connection does not support deadlines.
+func (cl *jsonclient) stop() error {
+	cl.stopping.Store(true)
+	return cl.c.SetReadDeadline(time.Now())
+}
+
 // handleJsonClient is a goroutine that handles one end of the socket pair.
 func handleJsonClient(c net.Conn, extraObjects map[string]any) {
+	newJsonClient(c).serve(extraObjects)
+}
+
+// serve reads and runs requests until the connection fails or the client is stopped,
+// then waits for requests being processed.
+//
+// Clients send newline-delimited json by default. A client sending a 0x00 byte first
+// switches the connection to cbor, where each message in both directions is a cbor
+// object prefixed with its length as a 32 bits big endian value.
+func (cl *jsonclient) serve(extraObjects map[string]any) {
+	c := cl.c
 	defer c.Close()
+	defer cl.inflight.Wait()
 
 	defer func() {
 		if e := recover(); e != nil {
@@ -174,33 +444,90 @@ func handleJsonClient(c net.Conn, extraObjects map[string]any) {
 		}
 	}()
 
-	cl := &jsonclient{
-		c:   c,
-		enc: json.NewEncoder(c),
-		id:  uuid.Must(uuid.NewRandom()),
+	st, err := tlsHandshake(c)
+	if err != nil {
+		log.Printf("json socket: tls handshake failed: %s", err)
+		return
+	}
+
+	// the client is set up before reading anything, so clients that only receive events
+	// get them. Messages are held until the encoding is known.
+	br := bufio.NewReader(c)
+	modeTimer := time.AfterFunc(SocketModeTimeout, func() { cl.setMode(false) })
+	defer func() {
+		modeTimer.Stop()
+		cl.setMode(false) // release writers if the client left before
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cl.ctx = New(ctx, "", "")
+	if cred, err := getPeerCred(c); err == nil {
+		cl.ctx.peer = cred
+	}
+	cl.ctx.tls = st
+	for k, v := range extraObjects {
+		cl.ctx.SetObject(k, v)
+	}
+	cl.ctx.SetObject("@client", cl)
+	for _, h := range SocketHooks {
+		if err := h(cl.ctx); err != nil {
+			// connection rejected, the error is sent with the client's encoding
+			c.SetReadDeadline(time.Now().Add(SocketModeTimeout))
+			cl.readMode(br)
+			cl.SendResponse(cl.ctx.errorResponse(err))
+			return
+		}
 	}
+
 	cl.register()
 	defer cl.deregister()
+	go cl.listen()
+
+	if err := cl.readMode(br); err != nil {
+		return
+	}
 
-	dec := json.NewDecoder(c)
+	dec := json.NewDecoder(br)
 
 	for {
-		obj := New(context.Background(), "", "")
-		if extraObjects != nil {
-			for k, v := range extraObjects {
-				obj.SetObject(k, v)
+		var msg []byte
+		typ := "application/json"
+		if cl.cbor {
+			typ = "application/cbor"
+			msg, err = readFrame(br)
+		} else {
+			var raw json.RawMessage
+			err = dec.Decode(&raw)
+			msg = raw
+		}
+		if err != nil {
+			if !cl.stopping.Load() && !errors.Is(err, io.EOF) {
+				log.Printf("failed to decode json request received from RPC: %s", err)
 			}
+			return
+		}
+		if !cl.cbor && isJsonRPC(msg) {
+			// JSON-RPC 2.0 request or batch, execute in background
+			cl.inflight.Add(1)
+			go cl.runRPC(msg, extraObjects)
+			continue
 		}
-		obj.SetObject("@client", cl)
-		obj.SetResponseSink(cl)
 
-		// SetDecoder will block to read and set context state based on one object read from the decoder
-		err := obj.SetDecoder(dec)
+		obj, err := NewChild(cl.ctx, msg, typ)
 		if err != nil {
 			log.Printf("failed to decode json request received from RPC: %s", err)
 			return
 		}
+		for k, v := range extraObjects {
+			obj.SetObject(k, v)
+		}
+		obj.SetObject("@client", cl)
+		obj.SetResponseSink(cl)
+
 		// execute in background
+		cl.inflight.Add(1)
 		go cl.run(obj)
 	}
 }
@@ -0,0 +1,108 @@
+package apirouter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+)
+
+// SocketHandshakeTimeout is the time allowed for the TLS handshake of connections
+// accepted by ListenJsonTCP.
+var SocketHandshakeTimeout = 10 * time.Second
+
+// ListenJsonTCP listens on the given TCP address and serves the same protocol as
+// ListenJsonUnix, including CBOR framing, over TLS. tlsConfig is required, see
+// [ListenJsonTCPInsecure] for plaintext connections. For mutual TLS, set ClientAuth and
+// ClientCAs in tlsConfig and map client certificates to users with [ClientCertHook]:
+//
+//	l, err := apirouter.ListenJsonTCP(":7443", &tls.Config{
+//		Certificates: []tls.Certificate{cert},
+//		ClientAuth:   tls.RequireAndVerifyClientCert,
+//		ClientCAs:    pool,
+//	}, nil)
+func ListenJsonTCP(addr string, tlsConfig *tls.Config, extraObjects map[string]any) (*JsonListener, error) {
+	if tlsConfig == nil {
+		return nil, errors.New("apirouter: ListenJsonTCP requires a TLS configuration, use ListenJsonTCPInsecure for plaintext")
+	}
+	s, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return listenJson(tls.NewListener(s, tlsConfig), extraObjects), nil
+}
+
+// ListenJsonTCPInsecure is like [ListenJsonTCP] without TLS. Requests and responses,
+// including credentials, are sent in clear text, so it should only be used on trusted
+// networks such as loopback, or behind a TLS terminating proxy.
+func ListenJsonTCPInsecure(addr string, extraObjects map[string]any) (*JsonListener, error) {
+	s, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return listenJson(s, extraObjects), nil
+}
+
+func listenJson(s net.Listener, extraObjects map[string]any) *JsonListener {
+	l := newJsonListener(s, extraObjects)
+	go l.serve()
+	return l
+}
+
+// MakeJsonTCPListener is like [ListenJsonTCP], for callers that do not need to stop the
+// listener.
+func MakeJsonTCPListener(addr string, tlsConfig *tls.Config, extraObjects map[string]any) error {
+	_, err := ListenJsonTCP(addr, tlsConfig, extraObjects)
+	return err
+}
+
+// TLSState returns the TLS state of the connection the request was received on, or nil
+// if it does not use TLS.
+func (c *Context) TLSState() *tls.ConnectionState {
+	if c.req != nil {
+		return c.req.TLS
+	}
+	return c.goTop().tls
+}
+
+// ClientCertHook returns a hook setting the request's user from the verified TLS client
+// certificate of the connection, for use in SocketHooks or RequestHooks. fn returns the
+// user for a certificate, or an error to reject it. Requests without a verified client
+// certificate are left untouched, so ClientAuth should be set in the TLS configuration
+// to require one.
+//
+//	apirouter.SocketHooks = append(apirouter.SocketHooks, apirouter.ClientCertHook(func(cert *x509.Certificate) (any, error) {
+//		return loadService(cert.Subject.CommonName)
+//	}))
+func ClientCertHook(fn func(cert *x509.Certificate) (any, error)) RequestHook {
+	return func(c *Context) error {
+		st := c.TLSState()
+		if st == nil || len(st.VerifiedChains) == 0 || len(st.VerifiedChains[0]) == 0 {
+			return nil
+		}
+		user, err := fn(st.VerifiedChains[0][0])
+		if err != nil {
+			return err
+		}
+		c.SetUser(user)
+		return nil
+	}
+}
+
+// tlsHandshake completes the TLS handshake of c, if it is a TLS connection, and returns
+// the connection's state.
+func tlsHandshake(c net.Conn) (*tls.ConnectionState, error) {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	tc.SetDeadline(time.Now().Add(SocketHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+
+	st := tc.ConnectionState()
+	return &st, nil
+}
@@ -0,0 +1,214 @@
+package apirouter_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func listenSocket(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := apirouter.ListenJsonUnix(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return path
+}
+
+// TestSocketIdleEvents checks that clients receive events before sending anything.
+func TestSocketIdleEvents(t *testing.T) {
+	prevTimeout, prevHooks := apirouter.SocketModeTimeout, apirouter.SocketHooks
+	apirouter.SocketModeTimeout = 50 * time.Millisecond
+	apirouter.SocketHooks = append(apirouter.SocketHooks[:len(apirouter.SocketHooks):len(apirouter.SocketHooks)], func(c *apirouter.Context) error {
+		c.SetListen("socket-test", true)
+		return nil
+	})
+	t.Cleanup(func() {
+		apirouter.SocketModeTimeout, apirouter.SocketHooks = prevTimeout, prevHooks
+	})
+	path := listenSocket(t)
+
+	tests := []struct {
+		name string
+		cbor bool
+	}{
+		{"json", false},
+		{"cbor", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if tt.cbor {
+				c.Write([]byte{0})
+			}
+
+			got := make(chan map[string]any, 1)
+			go func() {
+				var msg map[string]any
+				if tt.cbor {
+					var hdr [4]byte
+					if _, err := io.ReadFull(c, hdr[:]); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+					if _, err := io.ReadFull(c, buf); err != nil {
+						return
+					}
+					cbor.Unmarshal(buf, &msg)
+				} else {
+					line, err := bufio.NewReader(c).ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					json.Unmarshal(line, &msg)
+				}
+				got <- msg
+			}()
+
+			// the client subscribes asynchronously, publish until it receives the event
+			tick := time.NewTicker(20 * time.Millisecond)
+			defer tick.Stop()
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case msg := <-got:
+					if msg["data"] != "hello" {
+						t.Errorf("unexpected message %v", msg)
+					}
+					return
+				case <-tick.C:
+					apirouter.SendWS(context.Background(), "socket-test", map[string]any{"result": "event", "data": "hello"})
+				case <-timeout:
+					t.Fatal("event not received")
+				}
+			}
+		})
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "api.sock")
+	l, err := apirouter.ListenJsonUnix(path, nil, apirouter.WithSocketMode(0600), apirouter.WithSocketOwner(-1, os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSocket == 0 || st.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket mode %s", st.Mode())
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 1 {
+		t.Errorf("expected only the socket in %s, got %d entries", dir, len(ents))
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte(`{"path": "RPCTest:echo", "params": {"Value": "hi"}}` + "\n"))
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Data string `json:"data"`
+	}
+	json.Unmarshal(line, &res)
+	if res.Data != "hi" {
+		t.Errorf("unexpected response %s", line)
+	}
+}
+
+func TestListenJsonTCP(t *testing.T) {
+	if _, err := apirouter.ListenJsonTCP("127.0.0.1:0", nil, nil); err == nil {
+		t.Fatal("expected ListenJsonTCP to require TLS")
+	}
+
+	l, err := apirouter.ListenJsonTCPInsecure("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte(`{"path": "RPCTest:echo", "params": {"Value": "tcp"}}` + "\n"))
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Data string `json:"data"`
+	}
+	json.Unmarshal(line, &res)
+	if res.Data != "tcp" {
+		t.Errorf("unexpected response %s", line)
+	}
+}
+
+// waitGoroutines waits until n goroutines have fn in their stack.
+func waitGoroutines(t *testing.T, fn string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		got := strings.Count(string(buf), fn)
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines running %s, got %d", n, fn, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSocketListenRelease checks that the event reader of a client is released when it
+// disconnects, without waiting for an event to be published.
+func TestSocketListenRelease(t *testing.T) {
+	const fn = "apirouter.(*jsonclient).listen("
+	path := listenSocket(t)
+	// clients of previous tests are gone
+	waitGoroutines(t, fn, 0)
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte(`{"path": "RPCTest:echo", "params": {"Value": "hi"}}` + "\n"))
+	if _, err := bufio.NewReader(c).ReadBytes('\n'); err != nil {
+		t.Fatal(err)
+	}
+	waitGoroutines(t, fn, 1)
+
+	c.Close()
+	waitGoroutines(t, fn, 0)
+}
@@ -10,7 +10,8 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// MakeJsonSocketFD returns a file descriptor (integer) for a new json socket
+// MakeJsonSocketFD returns a file descriptor (integer) for a new json socket. The same
+// protocol as MakeJsonUnixListener is used, including CBOR framing.
 func MakeJsonSocketFD(extraObjects map[string]any) (int, error) {
 	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
 	if err != nil {
@@ -0,0 +1,230 @@
+package apirouter
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+)
+
+// JWTKeySet holds the keys used to verify JWT signatures, identified by key id ("kid").
+// Supported keys are []byte of at least 32 bytes (HS256), *rsa.PublicKey (RS256), *ecdsa.PublicKey on P-256
+// (ES256) and ed25519.PublicKey (EdDSA). Each key is only used with its algorithm.
+//
+// A JWTKeySet is safe for concurrent use, and its keys can be replaced at any time, for
+// example to reload a JWKS file after rotation.
+type JWTKeySet struct {
+	keys map[string]*jwtKey
+	lk   sync.RWMutex
+}
+
+type jwtKey struct {
+	alg string
+	key any
+}
+
+// NewJWTKeySet returns an empty key set.
+func NewJWTKeySet() *JWTKeySet {
+	return &JWTKeySet{keys: make(map[string]*jwtKey)}
+}
+
+// Add adds a key with the given key id. Tokens without a key id are checked against all
+// keys matching their algorithm.
+func (s *JWTKeySet) Add(kid string, key any) error {
+	alg, err := jwtKeyAlg(key)
+	if err != nil {
+		return err
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.keys[kid] = &jwtKey{alg: alg, key: key}
+	return nil
+}
+
+// LoadJWKS replaces the keys of the set with the keys of the given JWKS file.
+func (s *JWTKeySet) LoadJWKS(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.ParseJWKS(data)
+}
+
+// ParseJWKS replaces the keys of the set with the keys of the given JWKS document:
+//
+//	{"keys": [{"kty": "RSA", "kid": "k1", "n": "...", "e": "AQAB"}, ...]}
+//
+// Keys of unsupported types or algorithms and malformed keys are skipped, so a provider
+// publishing new kinds of keys does not break verification. An error is returned, and
+// the keys of the set are kept, if the document has no usable key.
+func (s *JWTKeySet) ParseJWKS(data []byte) error {
+	var doc struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*jwtKey)
+	var skipped error
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err == nil && key == nil {
+			err = fmt.Errorf("unsupported key type %s", k.Kty)
+		}
+		if err != nil {
+			skipped = fmt.Errorf("jwks key %s: %w", k.Kid, err)
+			continue
+		}
+		alg, err := jwtKeyAlg(key)
+		if err != nil {
+			skipped = fmt.Errorf("jwks key %s: %w", k.Kid, err)
+			continue
+		}
+		if k.Alg != "" && k.Alg != alg {
+			skipped = fmt.Errorf("jwks key %s: unsupported algorithm %s", k.Kid, k.Alg)
+			continue
+		}
+		keys[k.Kid] = &jwtKey{alg: alg, key: key}
+	}
+	if len(keys) == 0 {
+		if skipped != nil {
+			return fmt.Errorf("jwks has no usable key, %w", skipped)
+		}
+		return errors.New("jwks has no usable key")
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.keys = keys
+	return nil
+}
+
+// lookup returns the keys to try for a token with the given algorithm and key id.
+func (s *JWTKeySet) lookup(alg, kid string) []any {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	if kid != "" {
+		if k, ok := s.keys[kid]; ok && k.alg == alg {
+			return []any{k.key}
+		}
+		return nil
+	}
+	var res []any
+	for _, k := range s.keys {
+		if k.alg == alg {
+			res = append(res, k.key)
+		}
+	}
+	return res
+}
+
+// jwtKeyAlg returns the algorithm a key is used with.
+func jwtKeyAlg(key any) (string, error) {
+	switch k := key.(type) {
+	case []byte:
+		if len(k) < sha256.Size {
+			return "", fmt.Errorf("hmac keys must be at least %d bytes", sha256.Size)
+		}
+		return "HS256", nil
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 ecdsa keys are supported")
+		}
+		return "ES256", nil
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// jwk is a key of a JWKS document (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// key returns the public key, or nil if the key type is not supported.
+func (k *jwk) key() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := jwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := jwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, nil
+	}
+}
+
+func jwkInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
@@ -0,0 +1,262 @@
+package apirouter
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTokenExpired is returned when an authentication token has expired.
+	ErrTokenExpired = &Error{Message: "Token has expired", Token: "error_token_expired", Code: http.StatusUnauthorized}
+
+	// ErrTokenInvalid is returned when an authentication token is malformed, has an invalid
+	// signature or does not match the expected issuer or audience.
+	ErrTokenInvalid = &Error{Message: "Invalid token", Token: "error_token_invalid", Code: http.StatusUnauthorized}
+)
+
+// JWTClaims are the claims of a verified JWT.
+type JWTClaims map[string]any
+
+// Subject returns the "sub" claim.
+func (c JWTClaims) Subject() string {
+	s, _ := c["sub"].(string)
+	return s
+}
+
+// Issuer returns the "iss" claim.
+func (c JWTClaims) Issuer() string {
+	s, _ := c["iss"].(string)
+	return s
+}
+
+// Audience returns the "aud" claim, which can be a single string or a list.
+func (c JWTClaims) Audience() []string {
+	switch v := c["aud"].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		res := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// Time returns the value of a numeric date claim such as "exp", "nbf" or "iat".
+func (c JWTClaims) Time(k string) (time.Time, bool) {
+	v, ok := c[k].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := v.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// JWTAuth authenticates requests with JWT bearer tokens signed with HS256, RS256, ES256
+// or EdDSA. Its Hook reads the Authorization header and sets the user of the request:
+//
+//	keys := apirouter.NewJWTKeySet()
+//	keys.LoadJWKS("/etc/app/jwks.json")
+//
+//	auth := &apirouter.JWTAuth{
+//		Keys:     keys,
+//		Issuer:   "https://auth.example.com",
+//		Audience: "api",
+//		Resolve: func(c *apirouter.Context, claims apirouter.JWTClaims) (any, error) {
+//			return loadUser(c, claims.Subject())
+//		},
+//	}
+//	apirouter.RequestHooks = append(apirouter.RequestHooks, auth.Hook)
+//	apirouter.WSAuthHooks = append(apirouter.WSAuthHooks, auth.WSAuthHook)
+type JWTAuth struct {
+	Keys      *JWTKeySet
+	Issuer    string        // if set, the "iss" claim must match
+	Audience  string        // if set, the "aud" claim must contain it
+	ClockSkew time.Duration // tolerance when checking "exp" and "nbf"
+
+	// Resolve returns the user for the claims of a verified token. If nil, the claims
+	// are used as the user.
+	Resolve func(c *Context, claims JWTClaims) (any, error)
+}
+
+// Hook is a RequestHook authenticating requests with an "Authorization: Bearer" header.
+// Requests without a bearer token are left untouched, requests with an invalid token
+// fail with ErrTokenInvalid or ErrTokenExpired. The token's expiry is set as the
+// user's expiry, see SetUserExpiry.
+func (a *JWTAuth) Hook(c *Context) error {
+	if c.req == nil {
+		return nil
+	}
+	scheme, token, ok := strings.Cut(c.req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil
+	}
+	return a.authenticate(c, strings.TrimSpace(token))
+}
+
+// WSAuthHook is a hook for WSAuthHooks, authenticating websocket connections with the
+// token passed in parameters:
+//
+//	{"path": "@auth", "verb": "POST", "params": {"token": "..."}}
+func (a *JWTAuth) WSAuthHook(c *Context) error {
+	token, ok := GetParam[string](c, "token")
+	if !ok || token == "" {
+		return ErrTokenInvalid
+	}
+	return a.authenticate(c, token)
+}
+
+func (a *JWTAuth) authenticate(c *Context, token string) error {
+	claims, err := a.Verify(token)
+	if err != nil {
+		return err
+	}
+	var user any = claims
+	if a.Resolve != nil {
+		user, err = a.Resolve(c, claims)
+		if err != nil {
+			return err
+		}
+	}
+	c.SetUser(user)
+	if exp, ok := claims.Time("exp"); ok {
+		c.SetUserExpiry(exp.Add(a.ClockSkew))
+	}
+	return nil
+}
+
+// Verify checks the signature and claims of token, and returns its claims.
+func (a *JWTAuth) Verify(token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := jwtDecode(parts[0], &hdr); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	if a.Keys != nil {
+		for _, key := range a.Keys.lookup(hdr.Alg, hdr.Kid) {
+			if jwtVerify(hdr.Alg, key, signed, sig) {
+				verified = true
+				break
+			}
+		}
+	}
+	if !verified {
+		return nil, ErrTokenInvalid
+	}
+
+	var claims JWTClaims
+	if err := jwtDecode(parts[1], &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *JWTAuth) checkClaims(claims JWTClaims) error {
+	now := time.Now()
+	if exp, ok := claims.Time("exp"); ok && now.After(exp.Add(a.ClockSkew)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(a.ClockSkew).Before(nbf) {
+		return ErrTokenInvalid
+	}
+	if a.Issuer != "" && claims.Issuer() != a.Issuer {
+		return ErrTokenInvalid
+	}
+	if a.Audience != "" {
+		found := false
+		for _, aud := range claims.Audience() {
+			if aud == a.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrTokenInvalid
+		}
+	}
+	return nil
+}
+
+// jwtDecode decodes a base64url encoded json value, keeping numbers as json.Number.
+func jwtDecode(s string, v any) error {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// jwtVerify checks the signature sig of signed with the given algorithm and key.
+func jwtVerify(alg string, key any, signed, sig []byte) bool {
+	switch alg {
+	case "HS256":
+		k, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		h := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s)
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(k, signed, sig)
+	default:
+		return false
+	}
+}
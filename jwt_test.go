@@ -0,0 +1,252 @@
+package apirouter_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+type jwtUser struct {
+	Sub string `json:"sub"`
+}
+
+func init() {
+	apirouter.RegisterStatic("JWTTest:whoami", func(ctx context.Context) (*jwtUser, error) {
+		u := apirouter.GetUser[jwtUser](ctx)
+		if u == nil {
+			return nil, apirouter.ErrAccessDenied
+		}
+		return u, nil
+	})
+}
+
+var (
+	jwtHMACKey            = []byte("0123456789abcdef0123456789abcdef")
+	jwtECKey, _           = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwtEdPub, jwtEdKey, _ = ed25519.GenerateKey(rand.Reader)
+	jwtRSAKey, _          = rsa.GenerateKey(rand.Reader, 2048)
+)
+
+// signJWT returns a token with the given claims, signed with key.
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	hdr, _ := json.Marshal(map[string]any{"alg": alg, "typ": "JWT", "kid": kid})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuth(t *testing.T) {
+	keys := apirouter.NewJWTKeySet()
+	for kid, k := range map[string]any{"hs": jwtHMACKey, "ec": &jwtECKey.PublicKey, "ed": jwtEdPub, "rs": &jwtRSAKey.PublicKey} {
+		if err := keys.Add(kid, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auth := &apirouter.JWTAuth{
+		Keys:     keys,
+		Issuer:   "https://auth.example.com",
+		Audience: "api",
+		Resolve: func(c *apirouter.Context, claims apirouter.JWTClaims) (any, error) {
+			return &jwtUser{Sub: claims.Subject()}, nil
+		},
+	}
+	prev := apirouter.RequestHooks
+	apirouter.RequestHooks = append(apirouter.RequestHooks[:len(prev):len(prev)], auth.Hook)
+	t.Cleanup(func() { apirouter.RequestHooks = prev })
+
+	now := time.Now().Unix()
+	claims := func(extra map[string]any) map[string]any {
+		res := map[string]any{"sub": "bob", "iss": "https://auth.example.com", "aud": "api", "exp": now + 60}
+		for k, v := range extra {
+			res[k] = v
+		}
+		return res
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string // expected error token, empty for success
+	}{
+		{"hs256", signJWT(t, "HS256", "hs", jwtHMACKey, claims(nil)), ""},
+		{"es256", signJWT(t, "ES256", "ec", jwtECKey, claims(nil)), ""},
+		{"eddsa", signJWT(t, "EdDSA", "ed", jwtEdKey, claims(nil)), ""},
+		{"rs256", signJWT(t, "RS256", "rs", jwtRSAKey, claims(nil)), ""},
+		{"no kid", signJWT(t, "HS256", "", jwtHMACKey, claims(nil)), ""},
+		{"audience list", signJWT(t, "HS256", "hs", jwtHMACKey, claims(map[string]any{"aud": []string{"other", "api"}})), ""},
+		{"no token", "", "error_access_denied"},
+		{"malformed", "not.a.token", "error_token_invalid"},
+		{"wrong key", signJWT(t, "HS256", "hs", []byte("fedcba9876543210fedcba9876543210"), claims(nil)), "error_token_invalid"},
+		{"algorithm mismatch", signJWT(t, "HS256", "ec", jwtHMACKey, claims(nil)), "error_token_invalid"},
+		{"none algorithm", signJWT(t, "none", "hs", nil, claims(nil)), "error_token_invalid"},
+		{"expired", signJWT(t, "HS256", "hs", jwtHMACKey, claims(map[string]any{"exp": now - 60})), "error_token_expired"},
+		{"not yet valid", signJWT(t, "HS256", "hs", jwtHMACKey, claims(map[string]any{"nbf": now + 60})), "error_token_invalid"},
+		{"wrong issuer", signJWT(t, "HS256", "hs", jwtHMACKey, claims(map[string]any{"iss": "https://evil.example.com"})), "error_token_invalid"},
+		{"wrong audience", signJWT(t, "HS256", "hs", jwtHMACKey, claims(map[string]any{"aud": "other"})), "error_token_invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []apiroutertest.Option
+			if tt.token != "" {
+				opts = append(opts, apiroutertest.WithHeader("Authorization", "Bearer "+tt.token))
+			}
+			res := apiroutertest.Call(t, "JWTTest:whoami", "GET", nil, opts...)
+			if tt.err != "" {
+				res.ExpectError(tt.err)
+				return
+			}
+			var u jwtUser
+			res.ExpectSuccess().Decode(&u)
+			if u.Sub != "bob" {
+				t.Errorf("expected user bob, got %q", u.Sub)
+			}
+		})
+	}
+}
+
+func TestJWTKeySetAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		key  any
+		ok   bool
+	}{
+		{"hmac", jwtHMACKey, true},
+		{"empty hmac", []byte{}, false},
+		{"nil hmac", []byte(nil), false},
+		{"short hmac", []byte("secret"), false},
+		{"ecdsa p-256", &jwtECKey.PublicKey, true},
+		{"ed25519", jwtEdPub, true},
+		{"private key", jwtEdKey, false},
+		{"string", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := apirouter.NewJWTKeySet().Add("k", tt.key)
+			if (err == nil) != tt.ok {
+				t.Errorf("expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func jwk(fields ...string) string {
+	res := "{"
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			res += ","
+		}
+		res += fmt.Sprintf("%q: %q", fields[i], fields[i+1])
+	}
+	return res + "}"
+}
+
+func TestJWTKeySetParseJWKS(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	ecKey := jwk("kty", "EC", "kid", "ec", "crv", "P-256", "x", b64(jwtECKey.X.Bytes()), "y", b64(jwtECKey.Y.Bytes()))
+	edKey := jwk("kty", "OKP", "kid", "ed", "crv", "Ed25519", "x", b64(jwtEdPub))
+	hsKey := jwk("kty", "oct", "kid", "hs", "k", b64(jwtHMACKey))
+
+	tests := []struct {
+		name  string
+		keys  []string
+		ok    bool
+		kids  []string // keys expected to verify tokens
+		nokid []string // keys expected to be skipped
+	}{
+		{"supported", []string{ecKey, edKey, hsKey}, true, []string{"ec", "ed", "hs"}, nil},
+		{"unsupported algorithm", []string{jwk("kty", "RSA", "kid", "ps", "alg", "PS256", "n", "AQAB", "e", "AQAB"), ecKey}, true, []string{"ec"}, nil},
+		{"empty secret", []string{jwk("kty", "oct", "kid", "hs", "k", ""), ecKey}, true, []string{"ec"}, []string{"hs"}},
+		{"short secret", []string{jwk("kty", "oct", "kid", "hs", "k", b64([]byte("secret"))), edKey}, true, []string{"ed"}, []string{"hs"}},
+		{"malformed", []string{jwk("kty", "EC", "kid", "bad", "crv", "P-256", "x", "!!", "y", ""), edKey}, true, []string{"ed"}, nil},
+		{"unknown type", []string{jwk("kty", "XYZ", "kid", "x"), hsKey}, true, []string{"hs"}, nil},
+		{"encryption key", []string{jwk("kty", "oct", "kid", "hs", "use", "enc", "k", b64(jwtHMACKey)), edKey}, true, []string{"ed"}, []string{"hs"}},
+		{"no usable key", []string{jwk("kty", "oct", "kid", "hs", "k", "")}, false, nil, nil},
+		{"empty", nil, false, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := apirouter.NewJWTKeySet()
+			// previous keys are kept if parsing fails
+			keys.Add("prev", []byte("prev-secret-0123456789abcdefghijk"))
+
+			doc := `{"keys": [`
+			for i, k := range tt.keys {
+				if i > 0 {
+					doc += ","
+				}
+				doc += k
+			}
+			doc += "]}"
+			err := keys.ParseJWKS([]byte(doc))
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got %v", tt.ok, err)
+			}
+
+			auth := &apirouter.JWTAuth{Keys: keys}
+			signers := map[string]func() string{
+				"ec": func() string { return signJWT(t, "ES256", "ec", jwtECKey, map[string]any{}) },
+				"ed": func() string { return signJWT(t, "EdDSA", "ed", jwtEdKey, map[string]any{}) },
+				"hs": func() string { return signJWT(t, "HS256", "hs", jwtHMACKey, map[string]any{}) },
+				"prev": func() string {
+					return signJWT(t, "HS256", "prev", []byte("prev-secret-0123456789abcdefghijk"), map[string]any{})
+				},
+			}
+			if !tt.ok {
+				if _, err := auth.Verify(signers["prev"]()); err != nil {
+					t.Errorf("previous keys were dropped: %s", err)
+				}
+				return
+			}
+			for _, kid := range tt.kids {
+				if _, err := auth.Verify(signers[kid]()); err != nil {
+					t.Errorf("key %s: %s", kid, err)
+				}
+			}
+			for _, kid := range tt.nokid {
+				if _, err := auth.Verify(signers[kid]()); err == nil {
+					t.Errorf("key %s should have been skipped", kid)
+				}
+			}
+		})
+	}
+}
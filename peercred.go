@@ -0,0 +1,66 @@
+package apirouter
+
+import (
+	"errors"
+	"net"
+)
+
+// PeerCred holds the credentials of the process on the other end of a UNIX socket, as
+// reported by the kernel when the connection was established.
+type PeerCred struct {
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+	Pid int32  `json:"pid"` // 0 if not available
+}
+
+var (
+	// SocketHooks run with the connection's context when a client connects to a json
+	// socket, whether created by ListenJsonUnix, ListenJsonTCP, MakeJsonSocketFD or
+	// ServeStdio. On UNIX sockets they can check the peer's credentials with PeerCred,
+	// and on TLS connections the client certificate, see ClientCertHook. A user set with
+	// SetUser applies to all requests of the connection. If a hook returns an error, it
+	// is sent to the client and the connection is closed.
+	//
+	//	apirouter.SocketHooks = append(apirouter.SocketHooks, func(c *apirouter.Context) error {
+	//		cred := c.PeerCred()
+	//		if cred == nil || cred.Uid != 0 {
+	//			return apirouter.ErrAccessDenied
+	//		}
+	//		c.SetUser(adminUser)
+	//		return nil
+	//	})
+	SocketHooks []RequestHook
+
+	// ErrPeerCredUnsupported is returned when peer credentials cannot be read on this
+	// platform.
+	ErrPeerCredUnsupported = errors.New("peer credentials are not supported on this platform")
+)
+
+// PeerCred returns the credentials of the peer of the UNIX socket the request was
+// received on, or nil if the request was not received on a UNIX socket or credentials
+// are not available.
+func (c *Context) PeerCred() *PeerCred {
+	return c.goTop().peer
+}
+
+// getPeerCred returns the credentials of the peer of c, which must be a UNIX socket.
+func getPeerCred(c net.Conn) (*PeerCred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket")
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var res *PeerCred
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		res, cerr = sockPeerCred(int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, cerr
+}
@@ -0,0 +1,20 @@
+//go:build darwin
+
+package apirouter
+
+import "golang.org/x/sys/unix"
+
+func sockPeerCred(fd int) (*PeerCred, error) {
+	cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+	res := &PeerCred{Uid: cred.Uid}
+	if cred.Ngroups > 0 {
+		res.Gid = cred.Groups[0]
+	}
+	if pid, err := unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID); err == nil {
+		res.Pid = int32(pid)
+	}
+	return res, nil
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package apirouter
+
+import "golang.org/x/sys/unix"
+
+func sockPeerCred(fd int) (*PeerCred, error) {
+	cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCred{Uid: cred.Uid, Gid: cred.Gid, Pid: cred.Pid}, nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package apirouter
+
+func sockPeerCred(fd int) (*PeerCred, error) {
+	return nil, ErrPeerCredUnsupported
+}
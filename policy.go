@@ -0,0 +1,129 @@
+package apirouter
+
+import (
+	"strings"
+	"sync"
+)
+
+// Policy describes who is allowed to call a route, see [SetPolicy]. All conditions set
+// must be met.
+type Policy struct {
+	Authenticated bool     `json:"authenticated,omitempty"` // a user must be set
+	Scopes        []string `json:"scopes,omitempty"`        // a user must be set and have all scopes, see Context.Scopes
+	Roles         []string `json:"roles,omitempty"`         // the user must have one of the roles, see RoleHolder
+	Description   string   `json:"description,omitempty"`   // documents Check in the schema
+
+	// Check, if set, is called with the request context and denies access if it returns
+	// false.
+	Check func(c *Context) bool `json:"-"`
+}
+
+var (
+	policies   = make(map[string]*Policy)
+	policiesLk sync.RWMutex
+)
+
+// SetPolicy sets the policy of a route, which is one of:
+//
+//   - an object, such as "User" or "Shop/Order": the policy applies to everything below
+//     it, including sub-objects
+//   - a static method, such as "User:search"
+//   - an action of an object: "User.fetch", "User.list", "User.create", "User.clear",
+//     "User.update" or "User.delete". Updating or deleting an object also fetches it, so
+//     the fetch policy applies too.
+//
+// Policies are checked once the target of a request is known and before calling it.
+// Requests that do not satisfy a policy fail with ErrAccessDenied. Policies appear in
+// the [Schema]. A nil policy removes the route's policy.
+//
+// A policy with Scopes requires an authenticated user. Users whose scopes were
+// restricted with SetScopes, such as API keys, must have all the scopes, while users
+// without restrictions have all scopes:
+//
+//	apirouter.RegisterStatic("User:search", searchUsers)
+//	apirouter.SetPolicy("User:search", &apirouter.Policy{Scopes: []string{"users:read"}})
+func SetPolicy(route string, p *Policy) {
+	policiesLk.Lock()
+	defer policiesLk.Unlock()
+
+	if p == nil {
+		delete(policies, route)
+		return
+	}
+	policies[route] = p
+}
+
+// GetPolicy returns the policy set for route, or nil.
+func GetPolicy(route string) *Policy {
+	policiesLk.RLock()
+	defer policiesLk.RUnlock()
+
+	return policies[route]
+}
+
+// checkPolicy returns ErrAccessDenied if c does not satisfy the policy of route.
+func (c *Context) checkPolicy(route string) error {
+	p := GetPolicy(route)
+	if p == nil || p.allows(c) {
+		return nil
+	}
+	return ErrAccessDenied
+}
+
+func (p *Policy) allows(c *Context) bool {
+	user := c.getUser()
+	if p.Authenticated && user == nil {
+		return false
+	}
+	if len(p.Scopes) > 0 {
+		// anonymous requests have no scope restriction, but no scope either
+		if user == nil {
+			return false
+		}
+		for _, s := range p.Scopes {
+			if !c.HasScope(s) {
+				return false
+			}
+		}
+	}
+	if len(p.Roles) > 0 {
+		rh, ok := user.(RoleHolder)
+		if !ok {
+			return false
+		}
+		found := false
+		for _, r := range p.Roles {
+			if rh.HasRole(r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.Check != nil && !p.Check(c) {
+		return false
+	}
+	return true
+}
+
+// String returns a description of the policy, such as "authenticated; scopes: a, b".
+func (p *Policy) String() string {
+	var res []string
+	if p.Authenticated {
+		res = append(res, "authenticated")
+	}
+	if len(p.Scopes) > 0 {
+		res = append(res, "scopes: "+strings.Join(p.Scopes, ", "))
+	}
+	if len(p.Roles) > 0 {
+		res = append(res, "roles: "+strings.Join(p.Roles, " or "))
+	}
+	if p.Description != "" {
+		res = append(res, p.Description)
+	} else if p.Check != nil {
+		res = append(res, "custom check")
+	}
+	return strings.Join(res, "; ")
+}
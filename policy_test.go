@@ -0,0 +1,72 @@
+package apirouter_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+type policyUser struct {
+	Roles []string
+}
+
+func (u *policyUser) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	apirouter.RegisterStatic("PolicyTest:run", func(ctx context.Context) (string, error) {
+		return "ok", nil
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	user := apiroutertest.WithUser(&policyUser{})
+	admin := apiroutertest.WithUser(&policyUser{Roles: []string{"admin"}})
+
+	tests := []struct {
+		name   string
+		route  string
+		policy *apirouter.Policy
+		opts   []apiroutertest.Option
+		ok     bool
+	}{
+		{"authenticated anonymous", "PolicyTest:run", &apirouter.Policy{Authenticated: true}, nil, false},
+		{"authenticated user", "PolicyTest:run", &apirouter.Policy{Authenticated: true}, []apiroutertest.Option{user}, true},
+		{"scopes anonymous", "PolicyTest:run", &apirouter.Policy{Scopes: []string{"read"}}, nil, false},
+		{"scopes anonymous with scopes", "PolicyTest:run", &apirouter.Policy{Scopes: []string{"read"}}, []apiroutertest.Option{apiroutertest.WithScopes("read")}, false},
+		{"scopes unrestricted user", "PolicyTest:run", &apirouter.Policy{Scopes: []string{"read"}}, []apiroutertest.Option{user}, true},
+		{"scopes granted", "PolicyTest:run", &apirouter.Policy{Scopes: []string{"read", "write"}}, []apiroutertest.Option{user, apiroutertest.WithScopes("read", "write")}, true},
+		{"scopes missing one", "PolicyTest:run", &apirouter.Policy{Scopes: []string{"read", "write"}}, []apiroutertest.Option{user, apiroutertest.WithScopes("read")}, false},
+		{"scopes wildcard", "PolicyTest:run", &apirouter.Policy{Scopes: []string{"read"}}, []apiroutertest.Option{user, apiroutertest.WithScopes("*")}, true},
+		{"scopes empty restriction", "PolicyTest:run", &apirouter.Policy{Scopes: []string{"read"}}, []apiroutertest.Option{user, apiroutertest.WithScopes()}, false},
+		{"roles anonymous", "PolicyTest:run", &apirouter.Policy{Roles: []string{"admin"}}, nil, false},
+		{"roles missing", "PolicyTest:run", &apirouter.Policy{Roles: []string{"admin"}}, []apiroutertest.Option{user}, false},
+		{"roles granted", "PolicyTest:run", &apirouter.Policy{Roles: []string{"staff", "admin"}}, []apiroutertest.Option{admin}, true},
+		{"check denied", "PolicyTest:run", &apirouter.Policy{Check: func(c *apirouter.Context) bool { return false }}, []apiroutertest.Option{admin}, false},
+		{"check allowed", "PolicyTest:run", &apirouter.Policy{Check: func(c *apirouter.Context) bool { return true }}, nil, true},
+		{"object anonymous", "PolicyTest", &apirouter.Policy{Authenticated: true}, nil, false},
+		{"object user", "PolicyTest", &apirouter.Policy{Authenticated: true}, []apiroutertest.Option{user}, true},
+		{"other route", "PolicyTest:other", &apirouter.Policy{Authenticated: true}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apirouter.SetPolicy(tt.route, tt.policy)
+			t.Cleanup(func() { apirouter.SetPolicy(tt.route, nil) })
+
+			res := apiroutertest.Call(t, "PolicyTest:run", "GET", nil, tt.opts...)
+			if tt.ok {
+				res.ExpectSuccess()
+			} else {
+				res.ExpectError("error_access_denied").ExpectCode(403)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package apirouter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Presence settings. Presence is disabled until PresenceChannel is set.
+var (
+	// PresenceChannel returns true for channels on which presence should be tracked.
+	// When a context with a user (see SetUser) starts listening on such a channel, a
+	// join event is sent on the channel, and a leave event once it stops listening or
+	// disconnects:
+	//
+	//	{"result": "presence", "action": "join", "channel": "doc:123", "user": {...}}
+	PresenceChannel func(channel string) bool
+
+	// PresenceIdentity returns a unique id for a user, and the information sent to other
+	// members in join and leave events. If nil, fmt.Sprint(user) is used as id and the
+	// user object itself is sent.
+	PresenceIdentity func(user any) (id string, info any)
+
+	// PresenceDebounce delays leave events, so a user leaving and joining again within
+	// this delay (for example when reconnecting) does not generate any event.
+	PresenceDebounce = 2 * time.Second
+)
+
+// PresenceMember is a user currently present on a channel, see [ListPresence].
+type PresenceMember struct {
+	Id   string `json:"id"`
+	User any    `json:"user"`
+
+	conns map[*Context]struct{}
+	leave *time.Timer
+}
+
+var (
+	presence   = make(map[string]map[string]*PresenceMember) // channel → user id → member
+	presenceLk sync.Mutex
+)
+
+// ListPresence returns the members present on the given channel on this instance,
+// sorted by id.
+func ListPresence(channel string) []*PresenceMember {
+	presenceLk.Lock()
+	defer presenceLk.Unlock()
+
+	res := make([]*PresenceMember, 0, len(presence[channel]))
+	for _, m := range presence[channel] {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Id < res[j].Id })
+	return res
+}
+
+func presenceIdentity(user any) (string, any) {
+	if PresenceIdentity != nil {
+		return PresenceIdentity(user)
+	}
+	return fmt.Sprint(user), user
+}
+
+func presenceEvent(channel, action string, m *PresenceMember) {
+	SendWS(context.Background(), channel, map[string]any{
+		"result":  "presence",
+		"action":  action,
+		"channel": channel,
+		"user":    m.User,
+	})
+}
+
+// presenceJoin registers c (a top level context) as present on channel. Only persistent
+// connections are tracked.
+func (c *Context) presenceJoin(channel string) {
+	user := c.getUser()
+	if PresenceChannel == nil || c.ws == nil || user == nil || !PresenceChannel(channel) {
+		return
+	}
+	id, info := presenceIdentity(user)
+
+	presenceLk.Lock()
+	members := presence[channel]
+	if members == nil {
+		members = make(map[string]*PresenceMember)
+		presence[channel] = members
+	}
+	if m, ok := members[id]; ok {
+		if m.leave != nil {
+			// user came back before leave was announced
+			m.leave.Stop()
+			m.leave = nil
+		}
+		m.conns[c] = struct{}{}
+		presenceLk.Unlock()
+		return
+	}
+
+	m := &PresenceMember{Id: id, User: info, conns: map[*Context]struct{}{c: {}}}
+	members[id] = m
+	presenceLk.Unlock()
+
+	presenceEvent(channel, "join", m)
+}
+
+// presenceLeave removes c from channel, announcing it after PresenceDebounce if this
+// was the user's last connection on the channel.
+func (c *Context) presenceLeave(channel string) {
+	presenceLk.Lock()
+	defer presenceLk.Unlock()
+
+	for id, m := range presence[channel] {
+		if _, ok := m.conns[c]; !ok {
+			continue
+		}
+		delete(m.conns, c)
+		if len(m.conns) > 0 {
+			return
+		}
+		m.leave = time.AfterFunc(PresenceDebounce, func() {
+			presenceLk.Lock()
+			members := presence[channel]
+			if members[id] != m || len(m.conns) > 0 {
+				// rejoined meanwhile
+				presenceLk.Unlock()
+				return
+			}
+			delete(members, id)
+			if len(members) == 0 {
+				delete(presence, channel)
+			}
+			presenceLk.Unlock()
+
+			presenceEvent(channel, "leave", m)
+		})
+		return
+	}
+}
+
+// presenceJoinAll registers c on all channels it already listens to, for subscriptions
+// made before the connection was established (for example in a request hook).
+func (c *Context) presenceJoinAll() {
+	if PresenceChannel == nil {
+		return
+	}
+	for _, ev := range c.GetListen() {
+		c.presenceJoin(ev)
+	}
+}
+
+// presenceLeaveAll removes c from all channels it listens to, typically on disconnect.
+func (c *Context) presenceLeaveAll() {
+	if PresenceChannel == nil {
+		return
+	}
+	for _, ev := range c.GetListen() {
+		if PresenceChannel(ev) {
+			c.presenceLeave(ev)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package apirouter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedProxies   []netip.Prefix
+	trustedProxiesLk sync.RWMutex
+)
+
+// SetTrustedProxies sets the addresses of the reverse proxies in front of the server, as
+// CIDRs such as "10.0.0.0/8" or single addresses such as "127.0.0.1". Only requests
+// coming from a trusted proxy have their Forwarded, X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host, X-Real-IP, Sec-Original-Host and Sec-Access-Prefix headers honored,
+// see [Context.ClientIP] and [Context.Scheme]. These headers are ignored until trusted
+// proxies are set, and calling it without arguments trusts no proxy.
+func SetTrustedProxies(proxies ...string) error {
+	res := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if strings.IndexByte(p, '/') == -1 {
+			ip, err := netip.ParseAddr(p)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %s: %w", p, err)
+			}
+			ip = ip.Unmap()
+			res = append(res, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		pfx, err := netip.ParsePrefix(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s: %w", p, err)
+		}
+		if pfx.Addr().Is4In6() {
+			pfx = netip.PrefixFrom(pfx.Addr().Unmap(), pfx.Bits()-96)
+		}
+		res = append(res, pfx.Masked())
+	}
+
+	trustedProxiesLk.Lock()
+	defer trustedProxiesLk.Unlock()
+
+	trustedProxies = res
+	return nil
+}
+
+// isTrustedProxy returns whether ip is a trusted proxy.
+func isTrustedProxy(ip netip.Addr) bool {
+	trustedProxiesLk.RLock()
+	defer trustedProxiesLk.RUnlock()
+
+	if !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded is the origin of a request, as resolved by resolveForwarded.
+type forwarded struct {
+	ip      netip.Addr // client address
+	proto   string     // scheme used by the client, if forwarded
+	host    string     // host requested by the client, if forwarded
+	trusted bool       // the peer is a trusted proxy, its Sec-* headers can be used
+}
+
+// resolveForwarded walks the forwarding headers of req from the nearest hop, for as long
+// as hops are trusted proxies. The client is the first hop that is not trusted.
+func resolveForwarded(req *http.Request) *forwarded {
+	res := &forwarded{}
+	if ap, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		res.ip = ap.Addr().Unmap()
+	} else if ip, err := netip.ParseAddr(req.RemoteAddr); err == nil {
+		res.ip = ip.Unmap()
+	}
+	res.trusted = isTrustedProxy(res.ip)
+	if !res.trusted {
+		return res
+	}
+
+	hops := parseForwardedHeader(req.Header.Values("Forwarded"))
+	if hops == nil {
+		for _, ip := range headerList(req.Header.Values("X-Forwarded-For")) {
+			hops = append(hops, &forwardedHop{ip: parseForwardedAddr(ip)})
+		}
+		protos := headerList(req.Header.Values("X-Forwarded-Proto"))
+		hosts := headerList(req.Header.Values("X-Forwarded-Host"))
+		for i, hop := range hops {
+			// each proxy may have appended a value, or only the first one set it
+			if len(protos) == len(hops) {
+				hop.proto = protos[i]
+			} else if len(protos) > 0 {
+				hop.proto = protos[0]
+			}
+			if len(hosts) == len(hops) {
+				hop.host = hosts[i]
+			} else if len(hosts) > 0 {
+				hop.host = hosts[0]
+			}
+		}
+	}
+	if hops == nil {
+		// a single proxy reporting the client with X-Real-IP, or only proto and host
+		if ip := parseForwardedAddr(req.Header.Get("X-Real-IP")); ip.IsValid() {
+			res.ip = ip
+		}
+		if protos := headerList(req.Header.Values("X-Forwarded-Proto")); len(protos) > 0 {
+			res.proto = strings.ToLower(protos[0])
+		}
+		if hosts := headerList(req.Header.Values("X-Forwarded-Host")); len(hosts) > 0 {
+			res.host = hosts[0]
+		}
+		return res
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if !hop.ip.IsValid() {
+			// "unknown" or obfuscated, the client is the proxy that reported it
+			break
+		}
+		res.ip = hop.ip
+		res.proto = strings.ToLower(hop.proto)
+		res.host = hop.host
+		if !isTrustedProxy(hop.ip) {
+			break
+		}
+	}
+	return res
+}
+
+type forwardedHop struct {
+	ip    netip.Addr
+	proto string
+	host  string
+}
+
+// parseForwardedHeader parses Forwarded headers (RFC 7239), such as:
+//
+//	Forwarded: for=192.0.2.60;proto=https;host=example.com, for="[2001:db8::17]:4711"
+func parseForwardedHeader(values []string) []*forwardedHop {
+	var res []*forwardedHop
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			hop := &forwardedHop{}
+			for _, pair := range splitQuoted(elem, ';') {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.Trim(val, `"`)
+				switch strings.ToLower(k) {
+				case "for":
+					hop.ip = parseForwardedAddr(val)
+				case "proto":
+					hop.proto = val
+				case "host":
+					hop.host = val
+				}
+			}
+			res = append(res, hop)
+		}
+	}
+	return res
+}
+
+// parseForwardedAddr parses an address with an optional port, such as "192.0.2.60",
+// "192.0.2.60:4711", "2001:db8::17" or "[2001:db8::17]:4711".
+func parseForwardedAddr(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return ip.Unmap()
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	ip, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap()
+}
+
+// headerList returns the comma separated values of a header.
+func headerList(values []string) []string {
+	var res []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// splitQuoted splits s on sep, ignoring separators within double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var res []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				res = append(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, s[start:])
+}
+
+// ClientIP returns the address of the client that made the request. Behind trusted
+// proxies (see [SetTrustedProxies]), this is the address found in forwarding headers.
+// For socket connections, this is the address of the peer if it connected over TCP. An
+// invalid address is returned if the address is not known.
+func (c *Context) ClientIP() netip.Addr {
+	if c.req != nil {
+		return resolveForwarded(c.req).ip
+	}
+	if cl, ok := c.GetObject("@client").(*jsonclient); ok {
+		if addr, ok := cl.c.RemoteAddr().(*net.TCPAddr); ok {
+			return addr.AddrPort().Addr().Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+// Scheme returns the scheme used by the client for HTTP and websocket requests, "http" or
+// "https", taking forwarding headers of trusted proxies into account. It returns an empty
+// string for other requests.
+func (c *Context) Scheme() string {
+	if c.req == nil {
+		return ""
+	}
+	return requestScheme(c.req, resolveForwarded(c.req))
+}
+
+func requestScheme(req *http.Request, fwd *forwarded) string {
+	switch fwd.proto {
+	case "http", "https":
+		return fwd.proto
+	case "ws":
+		return "http"
+	case "wss":
+		return "https"
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,130 @@
+package apirouter_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+func init() {
+	apirouter.RegisterStatic("ProxyTest:info", func(ctx context.Context) (any, error) {
+		var c *apirouter.Context
+		ctx.Value(&c)
+		var req *http.Request
+		ctx.Value(&req)
+		return map[string]any{
+			"ip":     c.ClientIP().String(),
+			"scheme": c.Scheme(),
+			"domain": c.GetDomain(),
+			"prefix": apirouter.GetPrefixForRequest(req).String(),
+		}, nil
+	})
+}
+
+func TestTrustedProxies(t *testing.T) {
+	// requests made by apiroutertest come from 192.0.2.1
+	tests := []struct {
+		name    string
+		proxies []string
+		headers map[string]string
+		want    map[string]string
+	}{
+		{
+			name:    "no proxy",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.5", "X-Forwarded-Proto": "https", "Sec-Original-Host": "evil.example", "Sec-Access-Prefix": "/evil"},
+			want:    map[string]string{"ip": "192.0.2.1", "scheme": "http", "domain": "localhost", "prefix": "http://localhost/"},
+		},
+		{
+			name:    "untrusted peer",
+			proxies: []string{"10.0.0.0/8"},
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.5", "Sec-Original-Host": "evil.example"},
+			want:    map[string]string{"ip": "192.0.2.1", "domain": "localhost"},
+		},
+		{
+			name:    "x-forwarded",
+			proxies: []string{"192.0.2.1"},
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.5", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "shop.example"},
+			want:    map[string]string{"ip": "203.0.113.5", "scheme": "https", "domain": "shop.example"},
+		},
+		{
+			name:    "spoofed hop",
+			proxies: []string{"192.0.2.0/24"},
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.5"},
+			want:    map[string]string{"ip": "203.0.113.5"},
+		},
+		{
+			name:    "proxy chain",
+			proxies: []string{"192.0.2.0/24", "10.0.0.0/8"},
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.5, 10.1.2.3"},
+			want:    map[string]string{"ip": "203.0.113.5"},
+		},
+		{
+			name:    "forwarded",
+			proxies: []string{"192.0.2.1"},
+			headers: map[string]string{"Forwarded": `for="[2001:db8::17]:4711";proto=https;host=shop.example`},
+			want:    map[string]string{"ip": "2001:db8::17", "scheme": "https", "domain": "shop.example"},
+		},
+		{
+			name:    "x-real-ip",
+			proxies: []string{"192.0.2.1"},
+			headers: map[string]string{"X-Real-IP": "203.0.113.5"},
+			want:    map[string]string{"ip": "203.0.113.5"},
+		},
+		{
+			name:    "x-real-ip with proto and host",
+			proxies: []string{"192.0.2.1"},
+			headers: map[string]string{"X-Real-IP": "203.0.113.5", "X-Forwarded-Proto": "HTTPS", "X-Forwarded-Host": "shop.example"},
+			want:    map[string]string{"ip": "203.0.113.5", "scheme": "https", "domain": "shop.example", "prefix": "https://shop.example/"},
+		},
+		{
+			name:    "proto and host only",
+			proxies: []string{"192.0.2.1"},
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "shop.example"},
+			want:    map[string]string{"ip": "192.0.2.1", "scheme": "https", "domain": "shop.example"},
+		},
+		{
+			name:    "untrusted x-real-ip with proto",
+			proxies: []string{"10.0.0.0/8"},
+			headers: map[string]string{"X-Real-IP": "203.0.113.5", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"},
+			want:    map[string]string{"ip": "192.0.2.1", "scheme": "http", "domain": "localhost"},
+		},
+		{
+			name:    "sec headers",
+			proxies: []string{"192.0.2.1"},
+			headers: map[string]string{"Sec-Original-Host": "shop.example", "Sec-Access-Prefix": "api"},
+			want:    map[string]string{"domain": "shop.example", "prefix": "http://shop.example/api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := apirouter.SetTrustedProxies(tt.proxies...); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { apirouter.SetTrustedProxies() })
+
+			var opts []apiroutertest.Option
+			for k, v := range tt.headers {
+				opts = append(opts, apiroutertest.WithHeader(k, v))
+			}
+			var got map[string]string
+			apiroutertest.Call(t, "ProxyTest:info", "GET", nil, opts...).ExpectSuccess().Decode(&got)
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s: expected %q, got %q", k, v, got[k])
+				}
+			}
+		})
+	}
+}
+
+func TestSetTrustedProxiesInvalid(t *testing.T) {
+	for _, p := range []string{"", "example.com", "10.0.0.0/33", "::ffff:10.0.0.1/200"} {
+		if err := apirouter.SetTrustedProxies(p); err == nil {
+			t.Errorf("expected %q to be rejected", p)
+		}
+	}
+	apirouter.SetTrustedProxies()
+}
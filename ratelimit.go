@@ -0,0 +1,306 @@
+package apirouter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrTooManyRequests is returned when a request exceeds a rate limit (429). The error
+// returned to clients has the limit's state as error info, with times in seconds:
+//
+//	{"limit": 5, "remaining": 0, "reset": 1, "retry_after": 1}
+var ErrTooManyRequests = &Error{Message: "Too many requests", Token: "error_too_many_requests", Code: http.StatusTooManyRequests}
+
+// RateLimitAlgorithm selects how requests are counted, see [RateLimit].
+type RateLimitAlgorithm int
+
+const (
+	// TokenBucket allows bursts of up to Limit requests, refilled at Limit per Window.
+	TokenBucket RateLimitAlgorithm = iota
+	// SlidingWindow allows Limit requests in any Window, estimated from the counts of
+	// the current and previous windows.
+	SlidingWindow
+)
+
+// RateLimitKey returns the key requests are counted under. Requests for which it returns
+// an empty string are not limited.
+type RateLimitKey func(c *Context) string
+
+// RateLimit limits requests on a route, see [SetRateLimit].
+type RateLimit struct {
+	Limit     int           // requests allowed per Window
+	Window    time.Duration // period of the limit
+	Algorithm RateLimitAlgorithm
+	Key       RateLimitKey // RateLimitByUserOrIP if nil
+}
+
+// RateLimitResult is the state of a rate limit after a request.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the limit is fully available again
+	RetryAfter time.Duration // until the next request is allowed, if not allowed
+}
+
+// RateLimitStore keeps the state of rate limits.
+type RateLimitStore interface {
+	// TakeRateLimit counts a request for key under l.
+	TakeRateLimit(ctx context.Context, key string, l *RateLimit) (*RateLimitResult, error)
+}
+
+var (
+	// RateLimitBackend stores the state of rate limits. It defaults to an in-memory
+	// store, use a shared store when running several instances.
+	RateLimitBackend RateLimitStore = NewMemoryRateLimitStore()
+
+	rateLimits   = make(map[string][]*RateLimit)
+	rateLimitsLk sync.RWMutex
+)
+
+// SetRateLimit sets the rate limits of a route, which are named like in [SetPolicy]. The
+// empty route applies to all requests. All limits of a route must allow a request, and
+// limits set on an object apply to each request below it. Calling SetRateLimit without
+// limits removes the route's limits.
+//
+// Limits are checked after policies, and also apply to requests sent on websockets and
+// sockets. Requests over a limit fail with ErrTooManyRequests.
+//
+//	apirouter.SetRateLimit("User:search",
+//		&apirouter.RateLimit{Limit: 5, Window: time.Second},
+//		&apirouter.RateLimit{Limit: 1000, Window: 24 * time.Hour, Algorithm: apirouter.SlidingWindow, Key: apirouter.RateLimitByUser},
+//	)
+func SetRateLimit(route string, limits ...*RateLimit) {
+	rateLimitsLk.Lock()
+	defer rateLimitsLk.Unlock()
+
+	if len(limits) == 0 {
+		delete(rateLimits, route)
+		return
+	}
+	for _, l := range limits {
+		if l.Limit <= 0 || l.Window <= 0 {
+			panic("apirouter: rate limit requires a positive Limit and Window")
+		}
+	}
+	rateLimits[route] = limits
+}
+
+// GetRateLimit returns the rate limits set for route.
+func GetRateLimit(route string) []*RateLimit {
+	rateLimitsLk.RLock()
+	defer rateLimitsLk.RUnlock()
+
+	return rateLimits[route]
+}
+
+// RateLimitByIP counts requests per remote address.
+func RateLimitByIP(c *Context) string {
+	return "ip:" + c.RemoteAddr()
+}
+
+// RateLimitByUser counts requests per user, see [PresenceIdentity]. Anonymous requests
+// are not limited.
+func RateLimitByUser(c *Context) string {
+	user := c.getUser()
+	if user == nil {
+		return ""
+	}
+	id, _ := presenceIdentity(user)
+	return "user:" + id
+}
+
+// RateLimitByApiKey counts requests per API key, see [ApiKeyAuth]. Requests without an
+// API key are not limited.
+func RateLimitByApiKey(c *Context) string {
+	k, ok := c.GetObject("@api_key").(*ApiKey)
+	if !ok {
+		return ""
+	}
+	return "apikey:" + k.Id
+}
+
+// RateLimitByUserOrIP counts requests per user, or per remote address for anonymous
+// requests.
+func RateLimitByUserOrIP(c *Context) string {
+	if k := RateLimitByUser(c); k != "" {
+		return k
+	}
+	return RateLimitByIP(c)
+}
+
+// RateLimitByRoute counts all requests on the route together.
+func RateLimitByRoute(c *Context) string {
+	return "route"
+}
+
+// checkRoute checks the policy and rate limits of route.
+func (c *Context) checkRoute(route string) error {
+	if err := c.checkPolicy(route); err != nil {
+		return err
+	}
+	return c.checkRateLimit(route)
+}
+
+// checkRateLimit counts the request against the rate limits of route, and returns an
+// error if one is exceeded. The most restrictive result is kept for response headers.
+func (c *Context) checkRateLimit(route string) error {
+	for _, l := range GetRateLimit(route) {
+		keyFunc := l.Key
+		if keyFunc == nil {
+			keyFunc = RateLimitByUserOrIP
+		}
+		k := keyFunc(c)
+		if k == "" {
+			continue
+		}
+		res, err := RateLimitBackend.TakeRateLimit(c, fmt.Sprintf("%s|%d/%s|%s", route, l.Limit, l.Window, k), l)
+		if err != nil {
+			// do not fail requests because the store is unavailable
+			slog.ErrorContext(c, fmt.Sprintf("[api] rate limit store failed: %s", err), "event", "apirouter:ratelimit:error")
+			continue
+		}
+		if c.rateLimit == nil || !res.Allowed || res.Remaining < c.rateLimit.Remaining {
+			c.rateLimit = res
+		}
+		if !res.Allowed {
+			return &Error{Message: ErrTooManyRequests.Message, Token: ErrTooManyRequests.Token, Code: ErrTooManyRequests.Code, Info: res.info(), parent: ErrTooManyRequests}
+		}
+	}
+	return nil
+}
+
+func (r *RateLimitResult) info() map[string]any {
+	return map[string]any{
+		"limit":       r.Limit,
+		"remaining":   r.Remaining,
+		"reset":       ceilSeconds(r.Reset),
+		"retry_after": ceilSeconds(r.RetryAfter),
+	}
+}
+
+// setHeaders sets the RateLimit-* headers, and Retry-After if the request was refused.
+func (r *RateLimitResult) setHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(r.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(r.Reset), 10))
+	if !r.Allowed {
+		h.Set("Retry-After", strconv.FormatInt(ceilSeconds(r.RetryAfter), 10))
+	}
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimitStore is a [RateLimitStore] keeping rate limits in memory.
+type MemoryRateLimitStore struct {
+	entries map[string]*rateLimitEntry
+	lk      sync.Mutex
+	swept   time.Time
+}
+
+type rateLimitEntry struct {
+	// token bucket
+	tokens float64
+	last   time.Time
+
+	// sliding window
+	start time.Time // start of the current window
+	cur   int
+	prev  int
+
+	expires time.Time // when the entry is back to its initial state
+}
+
+// NewMemoryRateLimitStore returns a new empty store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{entries: make(map[string]*rateLimitEntry), swept: time.Now()}
+}
+
+func (s *MemoryRateLimitStore) TakeRateLimit(ctx context.Context, key string, l *RateLimit) (*RateLimitResult, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.swept) > time.Minute {
+		s.sweep(now)
+	}
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &rateLimitEntry{tokens: float64(l.Limit), last: now, start: now}
+		s.entries[key] = e
+	}
+	if l.Algorithm == SlidingWindow {
+		return e.takeWindow(l, now), nil
+	}
+	return e.takeToken(l, now), nil
+}
+
+// sweep removes entries back to their initial state.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for k, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	s.swept = now
+}
+
+func (e *rateLimitEntry) takeToken(l *RateLimit, now time.Time) *RateLimitResult {
+	limit := float64(l.Limit)
+	rate := limit / l.Window.Seconds() // tokens per second
+
+	e.tokens = math.Min(limit, e.tokens+now.Sub(e.last).Seconds()*rate)
+	e.last = now
+
+	res := &RateLimitResult{Limit: l.Limit}
+	if e.tokens >= 1 {
+		e.tokens -= 1
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - e.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(e.tokens)
+	res.Reset = time.Duration((limit - e.tokens) / rate * float64(time.Second))
+	e.expires = now.Add(res.Reset)
+	return res
+}
+
+func (e *rateLimitEntry) takeWindow(l *RateLimit, now time.Time) *RateLimitResult {
+	if elapsed := now.Sub(e.start); elapsed >= l.Window {
+		n := elapsed / l.Window
+		if n == 1 {
+			e.prev = e.cur
+		} else {
+			e.prev = 0
+		}
+		e.cur = 0
+		e.start = e.start.Add(n * l.Window)
+	}
+	elapsed := now.Sub(e.start)
+	weight := 1 - float64(elapsed)/float64(l.Window)
+	count := float64(e.prev)*weight + float64(e.cur)
+
+	res := &RateLimitResult{Limit: l.Limit, Reset: l.Window - elapsed}
+	if count < float64(l.Limit) {
+		e.cur += 1
+		count += 1
+		res.Allowed = true
+	} else if e.cur >= l.Limit {
+		res.RetryAfter = l.Window - elapsed
+	} else {
+		// wait until the previous window's weight drops enough
+		res.RetryAfter = time.Duration(float64(l.Window)*(1-float64(l.Limit-e.cur)/float64(e.prev))) - elapsed
+	}
+	res.Remaining = max(0, l.Limit-int(math.Ceil(count)))
+	e.expires = e.start.Add(2 * l.Window)
+	return res
+}
@@ -0,0 +1,112 @@
+package apirouter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+type rateUser struct {
+	Id string `json:"id"`
+}
+
+func init() {
+	apirouter.RegisterStatic("RateTest:hit", func(ctx context.Context) (string, error) {
+		return "ok", nil
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	alice := apiroutertest.WithUser(&rateUser{Id: "alice"})
+	bob := apiroutertest.WithUser(&rateUser{Id: "bob"})
+
+	tests := []struct {
+		name  string
+		limit *apirouter.RateLimit
+		calls []apiroutertest.Option // one call per entry, nil for anonymous
+		want  []bool                 // whether each call is allowed
+	}{
+		{
+			name:  "token bucket",
+			limit: &apirouter.RateLimit{Limit: 2, Window: time.Hour},
+			calls: []apiroutertest.Option{nil, nil, nil},
+			want:  []bool{true, true, false},
+		},
+		{
+			name:  "sliding window",
+			limit: &apirouter.RateLimit{Limit: 2, Window: time.Hour, Algorithm: apirouter.SlidingWindow},
+			calls: []apiroutertest.Option{nil, nil, nil},
+			want:  []bool{true, true, false},
+		},
+		{
+			name:  "per user",
+			limit: &apirouter.RateLimit{Limit: 1, Window: time.Hour, Key: apirouter.RateLimitByUser},
+			calls: []apiroutertest.Option{alice, bob, alice, nil, nil},
+			want:  []bool{true, true, false, true, true},
+		},
+		{
+			name:  "per user or ip",
+			limit: &apirouter.RateLimit{Limit: 1, Window: time.Hour},
+			calls: []apiroutertest.Option{alice, nil, alice, nil},
+			want:  []bool{true, true, false, false},
+		},
+		{
+			name:  "per route",
+			limit: &apirouter.RateLimit{Limit: 2, Window: time.Hour, Key: apirouter.RateLimitByRoute},
+			calls: []apiroutertest.Option{alice, bob, nil},
+			want:  []bool{true, true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := apirouter.RateLimitBackend
+			apirouter.RateLimitBackend = apirouter.NewMemoryRateLimitStore()
+			apirouter.SetRateLimit("RateTest:hit", tt.limit)
+			t.Cleanup(func() {
+				apirouter.SetRateLimit("RateTest:hit")
+				apirouter.RateLimitBackend = prev
+			})
+
+			for i, opt := range tt.calls {
+				var opts []apiroutertest.Option
+				if opt != nil {
+					opts = append(opts, opt)
+				}
+				res := apiroutertest.Call(t, "RateTest:hit", "GET", nil, opts...)
+				if !tt.want[i] {
+					res.ExpectError("error_too_many_requests").ExpectCode(429)
+					continue
+				}
+				res.ExpectSuccess()
+			}
+		})
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	prev := apirouter.RateLimitBackend
+	apirouter.RateLimitBackend = apirouter.NewMemoryRateLimitStore()
+	apirouter.SetRateLimit("RateTest:hit", &apirouter.RateLimit{Limit: 1, Window: time.Minute})
+	t.Cleanup(func() {
+		apirouter.SetRateLimit("RateTest:hit")
+		apirouter.RateLimitBackend = prev
+	})
+
+	apiroutertest.Call(t, "RateTest:hit", "GET", nil).ExpectSuccess()
+	res := apiroutertest.Call(t, "RateTest:hit", "GET", nil).ExpectError("error_too_many_requests")
+
+	info, ok := res.ErrorInfo.(map[string]any)
+	if !ok {
+		t.Fatalf("expected error info, got %#v", res.ErrorInfo)
+	}
+	if info["limit"] != 1 || info["remaining"] != 0 {
+		t.Errorf("unexpected error info %v", info)
+	}
+	if ra, _ := info["retry_after"].(int64); ra < 1 || ra > 60 {
+		t.Errorf("unexpected retry_after %v", info["retry_after"])
+	}
+}
@@ -124,6 +124,7 @@ func (c *Context) Response() (res *Response, err error) {
 			return
 		}
 	}
+	c.wsApplyAuth()
 
 	code := http.StatusOK
 	var val any
@@ -247,6 +248,9 @@ func (r *Response) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	// access-control-allow-credentials: true
 	// access-control-allow-origin: *
+	if rl := r.ctx.rateLimit; rl != nil {
+		rl.setHeaders(rw.Header())
+	}
 	rw.Header().Set("Access-Control-Allow-Credentials", "true")
 	if origin := req.Header.Get("Origin"); origin != "" {
 		rw.Header().Set("Vary", "Accept-Encoding,Origin")
@@ -0,0 +1,424 @@
+package apirouter
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/pobj"
+	"github.com/KarpelesLab/typutil"
+)
+
+// SchemaHook guards the @schema endpoint, which returns the [Schema] of the API. The
+// endpoint is disabled (returns ErrNotFound) while SchemaHook is nil.
+var SchemaHook RequestHook
+
+// Schema describes the objects, methods, types and errors of the API. It is used to
+// generate clients, see [GenerateTypeScript].
+type Schema struct {
+	Objects []*SchemaObject        `json:"objects"`
+	Types   map[string]*SchemaType `json:"types"`
+	Errors  []*SchemaError         `json:"errors"`
+}
+
+// SchemaObject is an object of the API, such as "User" or "Shop/Order".
+type SchemaObject struct {
+	Path    string            `json:"path"`
+	Type    string            `json:"type,omitempty"`    // type returned by fetch/list/create/update/delete
+	Actions []string          `json:"actions,omitempty"` // fetch, list, create, clear, update, delete
+	Params  map[string]string `json:"params,omitempty"`  // parameters of list, create and clear by action name, "" if none, see RegisterActions
+	Methods []*SchemaMethod   `json:"methods,omitempty"`
+
+	Policy         *Policy            `json:"policy,omitempty"`          // applies to the object and everything below it
+	ActionPolicies map[string]*Policy `json:"action_policies,omitempty"` // by action name
+}
+
+// SchemaMethod is a static method of an object, called as Object:name.
+type SchemaMethod struct {
+	Name   string  `json:"name"`
+	Params string  `json:"params,omitempty"` // type of the parameters, if any
+	Result string  `json:"result"`
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+// SchemaType describes a named struct type. Type expressions used in a schema are
+// either a name from Schema.Types, a basic type (string, number, boolean, any), T[],
+// Record<string, T>, or an inline object type.
+type SchemaType struct {
+	Fields []*SchemaField `json:"fields"`
+}
+
+// SchemaField is a field of a [SchemaType].
+type SchemaField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// SchemaError is an error that can be returned by the API, see [RegisterError].
+type SchemaError struct {
+	Token   string `json:"token"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+var (
+	statics   = make(map[string]reflect.Type) // "Object:method" → func type
+	actions   = make(map[string]reflect.Type) // "Object.action" → func type
+	staticsLk sync.RWMutex
+
+	knownErrors   = make(map[string]*Error)
+	knownErrorsLk sync.RWMutex
+)
+
+func init() {
+	RegisterError(ErrNotFound, ErrAccessDenied, ErrInternal, ErrInsecureRequest, ErrTeapot, ErrLengthRequired, ErrRequestEntityTooLarge, ErrSessionExpired, ErrTokenExpired, ErrTokenInvalid, ErrApiKeyInvalid, ErrApiKeyExpired, ErrSignatureInvalid, ErrSignatureExpired, ErrSignatureReplayed, ErrNonceStoreFull, ErrTooManyRequests)
+}
+
+// RegisterStatic registers a static method the same way as pobj.RegisterStatic, and
+// also records its signature so it appears in the [Schema]. Methods registered directly
+// with pobj work the same, but are not part of the schema.
+func RegisterStatic(name string, fn any) {
+	pobj.RegisterStatic(name, fn)
+
+	staticsLk.Lock()
+	defer staticsLk.Unlock()
+	statics[name] = reflect.TypeOf(fn)
+}
+
+// Actions are the functions implementing the actions of an object, see [RegisterActions].
+// Like static methods, they can take a context and the request parameters. Any of them
+// can be nil.
+type Actions struct {
+	Fetch  any // called with the id, as a string or as struct{ Id string }
+	List   any
+	Create any
+	Clear  any
+}
+
+// RegisterActions registers the actions of objects of type T the same way as
+// pobj.RegisterActions, and also records the parameters of List, Create and Clear so
+// they appear in the [Schema]. Objects registered directly with pobj work the same, but
+// their action parameters are not typed in the schema.
+func RegisterActions[T any](name string, a *Actions) *pobj.Object {
+	oa := &pobj.ObjectActions{}
+
+	staticsLk.Lock()
+	for _, act := range []struct {
+		name string
+		fn   any
+		dst  **typutil.Callable
+	}{{"fetch", a.Fetch, &oa.Fetch}, {"list", a.List, &oa.List}, {"create", a.Create, &oa.Create}, {"clear", a.Clear, &oa.Clear}} {
+		if act.fn == nil {
+			continue
+		}
+		*act.dst = typutil.Func(act.fn)
+		if t := reflect.TypeOf(act.fn); t.Kind() == reflect.Func {
+			actions[name+"."+act.name] = t
+		}
+	}
+	staticsLk.Unlock()
+
+	return pobj.RegisterActions[T](name, oa)
+}
+
+// RegisterError records errors the API may return so their tokens appear in the
+// [Schema]. Errors without a token are ignored.
+func RegisterError(errs ...*Error) {
+	knownErrorsLk.Lock()
+	defer knownErrorsLk.Unlock()
+
+	for _, e := range errs {
+		if e.Token != "" {
+			knownErrors[e.Token] = e
+		}
+	}
+}
+
+// GetSchema returns the schema of the API, built from the pobj registry.
+func GetSchema() *Schema {
+	b := &schemaBuilder{s: &Schema{Types: make(map[string]*SchemaType)}, names: make(map[reflect.Type]string), actions: make(map[string]reflect.Type)}
+
+	methods := make(map[string][]*SchemaMethod)
+	staticsLk.RLock()
+	names := make([]string, 0, len(statics))
+	for name := range statics {
+		names = append(names, name)
+	}
+	// types are named in the order they are found, keep it stable
+	sort.Strings(names)
+	for _, name := range names {
+		typ := statics[name]
+		pos := strings.IndexByte(name, ':')
+		m := b.method(name[pos+1:], typ)
+		m.Policy = GetPolicy(name)
+		methods[name[:pos]] = append(methods[name[:pos]], m)
+	}
+	for name, typ := range actions {
+		b.actions[name] = typ
+	}
+	staticsLk.RUnlock()
+
+	b.walk(pobj.Root(), "", methods)
+	if ms := methods[""]; len(ms) > 0 && !b.hasObject("") {
+		// statics registered on the root, such as ":ping"
+		b.s.Objects = append(b.s.Objects, &SchemaObject{Path: "", Methods: ms})
+	}
+	for _, o := range b.s.Objects {
+		sort.Slice(o.Methods, func(i, j int) bool { return o.Methods[i].Name < o.Methods[j].Name })
+	}
+	sort.Slice(b.s.Objects, func(i, j int) bool { return b.s.Objects[i].Path < b.s.Objects[j].Path })
+
+	knownErrorsLk.RLock()
+	for _, e := range knownErrors {
+		b.s.Errors = append(b.s.Errors, &SchemaError{Token: e.Token, Code: e.Code, Message: e.Message})
+	}
+	knownErrorsLk.RUnlock()
+	sort.Slice(b.s.Errors, func(i, j int) bool { return b.s.Errors[i].Token < b.s.Errors[j].Token })
+
+	return b.s
+}
+
+// schema implements the @schema special path.
+func (c *Context) schema() (any, error) {
+	if SchemaHook == nil {
+		return nil, ErrNotFound
+	}
+	if err := SchemaHook(c); err != nil {
+		return nil, err
+	}
+	return GetSchema(), nil
+}
+
+type schemaBuilder struct {
+	s       *Schema
+	names   map[reflect.Type]string
+	actions map[string]reflect.Type // copy of actions
+}
+
+var (
+	ctxType       = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errType       = reflect.TypeOf((*error)(nil)).Elem()
+	timeType      = reflect.TypeOf(time.Time{})
+	rawType       = reflect.TypeOf(json.RawMessage{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textType      = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	updatableType = reflect.TypeOf((*Updatable)(nil)).Elem()
+	deletableType = reflect.TypeOf((*Deletable)(nil)).Elem()
+)
+
+func (b *schemaBuilder) walk(o *pobj.Object, prefix string, methods map[string][]*SchemaMethod) {
+	names := o.Children()
+	sort.Strings(names)
+
+	for _, n := range names {
+		child := o.Child(n)
+		p := prefix + n
+
+		so := &SchemaObject{Path: p, Methods: methods[p], Policy: GetPolicy(p)}
+
+		if v := child.New(); v != nil {
+			typ := reflect.TypeOf(v)
+			so.Type = b.typeOf(typ)
+			if a := child.Action; a != nil {
+				for _, act := range []struct {
+					name string
+					fn   *typutil.Callable
+				}{{"fetch", a.Fetch}, {"list", a.List}, {"create", a.Create}, {"clear", a.Clear}} {
+					if act.fn == nil {
+						continue
+					}
+					so.Actions = append(so.Actions, act.name)
+					if fn, ok := b.actions[p+"."+act.name]; ok && act.name != "fetch" {
+						if so.Params == nil {
+							so.Params = make(map[string]string)
+						}
+						so.Params[act.name] = b.params(fn)
+					}
+				}
+				if a.Fetch != nil {
+					if typ.Implements(updatableType) {
+						so.Actions = append(so.Actions, "update")
+					}
+					if typ.Implements(deletableType) {
+						so.Actions = append(so.Actions, "delete")
+					}
+				}
+			}
+		}
+		for _, a := range so.Actions {
+			if pol := GetPolicy(p + "." + a); pol != nil {
+				if so.ActionPolicies == nil {
+					so.ActionPolicies = make(map[string]*Policy)
+				}
+				so.ActionPolicies[a] = pol
+			}
+		}
+		if so.Type != "" || len(so.Methods) > 0 {
+			b.s.Objects = append(b.s.Objects, so)
+		}
+
+		b.walk(child, p+"/", methods)
+	}
+}
+
+func (b *schemaBuilder) hasObject(p string) bool {
+	for _, o := range b.s.Objects {
+		if o.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *schemaBuilder) method(name string, fn reflect.Type) *SchemaMethod {
+	m := &SchemaMethod{Name: name, Result: "any", Params: b.params(fn)}
+	if fn.NumOut() > 0 && fn.Out(0) != errType {
+		m.Result = b.typeOf(fn.Out(0))
+	}
+	return m
+}
+
+// params returns the type of the parameters taken by fn, or an empty string if it takes
+// none.
+func (b *schemaBuilder) params(fn reflect.Type) string {
+	for i := 0; i < fn.NumIn(); i++ {
+		in := fn.In(i)
+		if in.Implements(ctxType) {
+			continue
+		}
+		// params are passed as the first argument
+		if t := deref(in); t.Kind() == reflect.Struct || t.Kind() == reflect.Map {
+			return b.typeOf(in)
+		}
+		return "Record<string, any>"
+	}
+	return ""
+}
+
+func deref(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// typeOf returns a type expression for t, registering named struct types.
+func (b *schemaBuilder) typeOf(t reflect.Type) string {
+	t = deref(t)
+
+	switch {
+	case t == timeType:
+		return "string"
+	case t == rawType:
+		return "any"
+	case t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType):
+		return "any"
+	case t.Implements(textType) || reflect.PointerTo(t).Implements(textType):
+		return "string"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// base64 encoded
+			return "string"
+		}
+		el := b.typeOf(t.Elem())
+		if strings.ContainsAny(el, " |") {
+			el = "(" + el + ")"
+		}
+		return el + "[]"
+	case reflect.Map:
+		return "Record<string, " + b.typeOf(t.Elem()) + ">"
+	case reflect.Struct:
+		if t.Name() == "" {
+			var s []string
+			for _, f := range b.fields(t) {
+				opt := ""
+				if f.Optional {
+					opt = "?"
+				}
+				s = append(s, f.Name+opt+": "+f.Type)
+			}
+			return "{ " + strings.Join(s, "; ") + " }"
+		}
+		return b.named(t)
+	default:
+		return "any"
+	}
+}
+
+func (b *schemaBuilder) named(t reflect.Type) string {
+	if n, ok := b.names[t]; ok {
+		return n
+	}
+	n := t.Name()
+	if i := strings.IndexByte(n, '['); i != -1 {
+		// generic type
+		n = n[:i]
+	}
+	if _, ok := b.s.Types[n]; ok {
+		// another type with the same name already exists
+		pkg := t.PkgPath()
+		pkg = pkg[strings.LastIndexByte(pkg, '/')+1:]
+		if pkg != "" {
+			n = strings.ToUpper(pkg[:1]) + pkg[1:] + n
+		}
+		base := n
+		for i := 2; ; i++ {
+			if _, ok := b.s.Types[n]; !ok {
+				break
+			}
+			n = base + strconv.Itoa(i)
+		}
+	}
+	st := &SchemaType{}
+	b.names[t] = n
+	b.s.Types[n] = st
+	st.Fields = b.fields(t)
+	return n
+}
+
+// fields returns the fields of struct t as encoded in JSON.
+func (b *schemaBuilder) fields(t reflect.Type) []*SchemaField {
+	var res []*SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && deref(f.Type).Kind() == reflect.Struct {
+			res = append(res, b.fields(deref(f.Type))...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		res = append(res, &SchemaField{
+			Name:     name,
+			Type:     b.typeOf(f.Type),
+			Optional: strings.Contains(opts, "omitempty") || f.Type.Kind() == reflect.Pointer,
+		})
+	}
+	return res
+}
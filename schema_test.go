@@ -0,0 +1,185 @@
+package apirouter_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+type SchemaWidget struct {
+	Id    string `json:"id"`
+	Label string `json:"label,omitempty"`
+}
+
+type schemaWidgetCreate struct {
+	Label string `json:"label"`
+}
+
+type schemaWidgetFilter struct {
+	Prefix string `json:"prefix,omitempty"`
+}
+
+type SchemaPage[T any] struct {
+	Items []T `json:"items"`
+}
+
+// Error has the same name as apirouter.Error
+type Error struct {
+	Reason string `json:"reason"`
+}
+
+func init() {
+	apirouter.RegisterActions[SchemaWidget]("SchemaWidget", &apirouter.Actions{
+		Fetch: func(ctx context.Context, id string) (*SchemaWidget, error) {
+			return &SchemaWidget{Id: id}, nil
+		},
+		List: func(ctx context.Context, in *schemaWidgetFilter) ([]*SchemaWidget, error) {
+			return []*SchemaWidget{{Id: "w1", Label: in.Prefix}}, nil
+		},
+		Create: func(ctx context.Context, in *schemaWidgetCreate) (*SchemaWidget, error) {
+			return &SchemaWidget{Id: "new", Label: in.Label}, nil
+		},
+		Clear: func(ctx context.Context) (any, error) {
+			return nil, nil
+		},
+	})
+	apirouter.RegisterStatic(":schemaTestPing", func(ctx context.Context) (string, error) {
+		return "pong", nil
+	})
+	apirouter.RegisterStatic("SchemaWidget:pages", func(ctx context.Context) (*SchemaPage[string], error) {
+		return nil, nil
+	})
+	apirouter.RegisterStatic("SchemaWidget:widgetPages", func(ctx context.Context) (*SchemaPage[SchemaWidget], error) {
+		return nil, nil
+	})
+	apirouter.RegisterStatic("SchemaWidget:errors", func(ctx context.Context, in struct{ Local bool }) (*Error, error) {
+		return nil, nil
+	})
+	apirouter.RegisterStatic("SchemaWidget:apiErrors", func(ctx context.Context, in map[string]any) (*apirouter.Error, error) {
+		return nil, nil
+	})
+}
+
+func schemaObject(t *testing.T, s *apirouter.Schema, path string) *apirouter.SchemaObject {
+	t.Helper()
+	for _, o := range s.Objects {
+		if o.Path == path {
+			return o
+		}
+	}
+	t.Fatalf("object %q not in schema", path)
+	return nil
+}
+
+func TestSchema(t *testing.T) {
+	s := apirouter.GetSchema()
+
+	w := schemaObject(t, s, "SchemaWidget")
+	if w.Type != "SchemaWidget" {
+		t.Errorf("expected type SchemaWidget, got %s", w.Type)
+	}
+	if got := strings.Join(w.Actions, ","); got != "fetch,list,create,clear" {
+		t.Errorf("unexpected actions %s", got)
+	}
+	for action, want := range map[string]string{"list": "schemaWidgetFilter", "create": "schemaWidgetCreate", "clear": ""} {
+		if got, ok := w.Params[action]; !ok || got != want {
+			t.Errorf("%s: expected params %q, got %q", action, want, got)
+		}
+	}
+
+	methods := make(map[string]*apirouter.SchemaMethod)
+	for _, m := range w.Methods {
+		methods[m.Name] = m
+	}
+	tests := []struct {
+		method, params, result string
+	}{
+		{"pages", "", "SchemaPage"},
+		{"widgetPages", "", "Apirouter_testSchemaPage"},
+		{"errors", "{ Local: boolean }", "Apirouter_testError"},
+		{"apiErrors", "Record<string, any>", "Error"},
+	}
+	for _, tt := range tests {
+		m := methods[tt.method]
+		if m == nil {
+			t.Errorf("method %s not in schema", tt.method)
+			continue
+		}
+		if m.Params != tt.params || m.Result != tt.result {
+			t.Errorf("%s: expected (%q) %q, got (%q) %q", tt.method, tt.params, tt.result, m.Params, m.Result)
+		}
+	}
+	if s.Types["Apirouter_testSchemaPage"] == nil || s.Types["Apirouter_testError"] == nil {
+		t.Error("types with conflicting names are missing")
+	}
+
+	root := schemaObject(t, s, "")
+	found := false
+	for _, m := range root.Methods {
+		found = found || m.Name == "schemaTestPing"
+	}
+	if !found {
+		t.Error("root static schemaTestPing not in schema")
+	}
+}
+
+func TestSchemaEndpoint(t *testing.T) {
+	apiroutertest.Call(t, "@schema", "GET", nil).ExpectError("error_not_found")
+
+	apirouter.SchemaHook = func(c *apirouter.Context) error { return nil }
+	t.Cleanup(func() { apirouter.SchemaHook = nil })
+
+	var s apirouter.Schema
+	apiroutertest.Call(t, "@schema", "GET", nil).ExpectSuccess().Decode(&s)
+	if w := schemaObject(t, &s, "SchemaWidget"); w.Params["create"] != "schemaWidgetCreate" {
+		t.Errorf("unexpected create params %q", w.Params["create"])
+	}
+
+	apirouter.SchemaHook = func(c *apirouter.Context) error { return apirouter.ErrAccessDenied }
+	apiroutertest.Call(t, "@schema", "GET", nil).ExpectError("error_access_denied")
+}
+
+func TestGenerateTypeScript(t *testing.T) {
+	var buf bytes.Buffer
+	if err := apirouter.GenerateTypeScript(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ts := buf.String()
+
+	for _, want := range []string{
+		"export interface SchemaWidget {\n  id: string;\n  label?: string;\n}",
+		"export interface schemaWidgetCreate {\n  label: string;\n}",
+		"export interface Apirouter_testSchemaPage {\n  items: SchemaWidget[];\n}",
+		"  | \"error_not_found\"",
+		"export class SchemaWidgetApi {",
+		"  fetch(id: string): Promise<SchemaWidget> {",
+		"  list(params?: schemaWidgetFilter): Promise<SchemaWidget[]> {\n    return this.t.call(\"SchemaWidget\", \"GET\", params);",
+		"  create(params: schemaWidgetCreate): Promise<SchemaWidget> {\n    return this.t.call(\"SchemaWidget\", \"POST\", params);",
+		"  clear(): Promise<any> {\n    return this.t.call(\"SchemaWidget\", \"DELETE\");",
+		"  errors(params: { Local: boolean }, onProgress?: (data: any) => void): Promise<Apirouter_testError> {",
+		"export class RootApi {",
+		"  schemaTestPing(onProgress?: (data: any) => void): Promise<string> {",
+		"  readonly schemaWidget: SchemaWidgetApi;",
+		"  readonly root: RootApi;",
+	} {
+		if !strings.Contains(ts, want) {
+			t.Errorf("generated client does not contain:\n%s", want)
+		}
+	}
+}
+
+func TestSchemaActionsCall(t *testing.T) {
+	var w SchemaWidget
+	apiroutertest.Call(t, "SchemaWidget", "POST", map[string]any{"label": "blue"}).ExpectSuccess().Decode(&w)
+	if w.Id != "new" || w.Label != "blue" {
+		t.Errorf("unexpected created widget %+v", w)
+	}
+	apiroutertest.Call(t, "SchemaWidget/w9", "GET", nil).ExpectSuccess().Decode(&w)
+	if w.Id != "w9" {
+		t.Errorf("unexpected fetched widget %+v", w)
+	}
+}
@@ -0,0 +1,314 @@
+package apirouter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// GenerateTypeScript writes a TypeScript client for the API registered in this process
+// to w. See [Schema.WriteTypeScript].
+func GenerateTypeScript(w io.Writer) error {
+	return GetSchema().WriteTypeScript(w)
+}
+
+// WriteTypeScript writes a typed TypeScript client for the schema to w. The output
+// contains an interface per type, an ErrorToken union of known error tokens, fetch and
+// WebSocket transports, and a class per object:
+//
+//	const api = new Api(new FetchTransport("https://example.com/_api"));
+//	const user = await api.user.fetch("123");
+func (s *Schema) WriteTypeScript(w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	fmt.Fprintf(out, "// Code generated by apirouter. DO NOT EDIT.\n\n")
+
+	// types
+	names := make([]string, 0, len(s.Types))
+	for n := range s.Types {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(out, "export interface %s {\n", n)
+		for _, f := range s.Types[n].Fields {
+			opt := ""
+			if f.Optional {
+				opt = "?"
+			}
+			fmt.Fprintf(out, "  %s%s: %s;\n", tsProperty(f.Name), opt, f.Type)
+		}
+		fmt.Fprintf(out, "}\n\n")
+	}
+
+	// errors
+	fmt.Fprintf(out, "export type ErrorToken =")
+	if len(s.Errors) == 0 {
+		fmt.Fprintf(out, " string")
+	}
+	for _, e := range s.Errors {
+		tok, _ := json.Marshal(e.Token)
+		fmt.Fprintf(out, "\n  | %s", tok)
+	}
+	fmt.Fprintf(out, ";\n\n")
+
+	out.WriteString(tsRuntime)
+
+	// objects
+	var props []string
+	for _, o := range s.Objects {
+		cls := tsClassName(o.Path)
+		props = append(props, tsLowerFirst(cls)+": "+cls+"Api")
+
+		path, _ := json.Marshal(o.Path)
+		if o.Policy != nil {
+			fmt.Fprintf(out, "%s\n", tsPolicy(o.Policy))
+		}
+		fmt.Fprintf(out, "export class %sApi {\n", cls)
+		fmt.Fprintf(out, "  constructor(private t: Transport) {}\n")
+
+		used := make(map[string]bool)
+		for _, a := range o.Actions {
+			used[a] = true
+			if p := o.ActionPolicies[a]; p != nil {
+				fmt.Fprintf(out, "\n  %s", tsPolicy(p))
+			}
+			switch a {
+			case "fetch":
+				fmt.Fprintf(out, "\n  fetch(id: string): Promise<%s> {\n    return this.t.call(%s + \"/\" + encodeURIComponent(id), \"GET\");\n  }\n", o.Type, path)
+			case "list":
+				arg, params := o.tsParams("list", "params?: Record<string, any>")
+				fmt.Fprintf(out, "\n  list(%s): Promise<%s[]> {\n    return this.t.call(%s, \"GET\"%s);\n  }\n", arg, o.Type, path, params)
+			case "create":
+				arg, params := o.tsParams("create", "params: Partial<"+o.Type+">")
+				fmt.Fprintf(out, "\n  create(%s): Promise<%s> {\n    return this.t.call(%s, \"POST\"%s);\n  }\n", arg, o.Type, path, params)
+			case "clear":
+				arg, params := o.tsParams("clear", "params?: Record<string, any>")
+				fmt.Fprintf(out, "\n  clear(%s): Promise<any> {\n    return this.t.call(%s, \"DELETE\"%s);\n  }\n", arg, path, params)
+			case "update":
+				fmt.Fprintf(out, "\n  update(id: string, params: Partial<%s>): Promise<%s> {\n    return this.t.call(%s + \"/\" + encodeURIComponent(id), \"PATCH\", params);\n  }\n", o.Type, o.Type, path)
+			case "delete":
+				fmt.Fprintf(out, "\n  delete(id: string): Promise<%s> {\n    return this.t.call(%s + \"/\" + encodeURIComponent(id), \"DELETE\");\n  }\n", o.Type, path)
+			}
+		}
+
+		for _, m := range o.Methods {
+			name := tsIdent(m.Name)
+			if used[name] {
+				name += "Static"
+			}
+			used[name] = true
+			mpath, _ := json.Marshal(o.Path + ":" + m.Name)
+			if m.Policy != nil {
+				fmt.Fprintf(out, "\n  %s", tsPolicy(m.Policy))
+			}
+			if m.Params == "" {
+				fmt.Fprintf(out, "\n  %s(onProgress?: (data: any) => void): Promise<%s> {\n    return this.t.call(%s, \"GET\", undefined, onProgress);\n  }\n", name, m.Result, mpath)
+			} else {
+				fmt.Fprintf(out, "\n  %s(params: %s, onProgress?: (data: any) => void): Promise<%s> {\n    return this.t.call(%s, \"POST\", params, onProgress);\n  }\n", name, m.Params, m.Result, mpath)
+			}
+		}
+		fmt.Fprintf(out, "}\n\n")
+	}
+
+	fmt.Fprintf(out, "export class Api {\n")
+	for _, p := range props {
+		fmt.Fprintf(out, "  readonly %s;\n", p)
+	}
+	fmt.Fprintf(out, "\n  constructor(public transport: Transport) {\n")
+	for _, p := range props {
+		prop, cls, _ := strings.Cut(p, ": ")
+		fmt.Fprintf(out, "    this.%s = new %s(transport);\n", prop, cls)
+	}
+	fmt.Fprintf(out, "  }\n}\n")
+
+	return out.Flush()
+}
+
+// tsParams returns the parameter declaration of an action method and the matching
+// argument to pass to call. def is used if the action's parameters are unknown.
+func (o *SchemaObject) tsParams(action, def string) (string, string) {
+	p, ok := o.Params[action]
+	switch {
+	case !ok:
+		return def, ", params"
+	case p == "":
+		return "", ""
+	case action == "create":
+		return "params: " + p, ", params"
+	default:
+		return "params?: " + p, ", params"
+	}
+}
+
+// tsPolicy returns a doc comment describing the access policy p.
+func tsPolicy(p *Policy) string {
+	return "/** Access: " + strings.ReplaceAll(p.String(), "*/", "* /") + " */"
+}
+
+// tsClassName turns an object path such as "Shop/Order" into "ShopOrder", and the root
+// object into "Root".
+func tsClassName(p string) string {
+	if p == "" {
+		return "Root"
+	}
+	var res []rune
+	upper := true
+	for _, r := range p {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		res = append(res, r)
+	}
+	return string(res)
+}
+
+func tsLowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+// tsIdent returns s with characters not allowed in identifiers replaced.
+func tsIdent(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// tsProperty returns s as a property name, quoted if needed.
+func tsProperty(s string) string {
+	if s != "" && tsIdent(s) == s && !unicode.IsDigit([]rune(s)[0]) {
+		return s
+	}
+	q, _ := json.Marshal(s)
+	return string(q)
+}
+
+const tsRuntime = `export class ApiError extends Error {
+  constructor(message: string, public code: number, public token?: ErrorToken | string, public info?: any) {
+    super(message);
+    this.name = "ApiError";
+  }
+}
+
+export interface Transport {
+  call<T>(path: string, verb: string, params?: any, onProgress?: (data: any) => void): Promise<T>;
+}
+
+function parseResponse<T>(res: any): T {
+  if (res.result === "error") {
+    throw new ApiError(res.error, res.code ?? 500, res.token, res.error_info);
+  }
+  if (res.result === "redirect") {
+    throw new ApiError("Redirect required to " + res.redirect_url, res.redirect_code ?? 302, undefined, { redirect_url: res.redirect_url });
+  }
+  return res.data as T;
+}
+
+export class FetchTransport implements Transport {
+  constructor(public baseUrl: string, public init: RequestInit = {}) {}
+
+  async call<T>(path: string, verb: string, params?: any): Promise<T> {
+    let url = this.baseUrl.replace(/\/+$/, "") + "/" + path;
+    const headers: Record<string, string> = { ...(this.init.headers as Record<string, string>), Accept: "application/json" };
+    const init: RequestInit = { ...this.init, method: verb, headers };
+    if (params !== undefined) {
+      if (verb === "POST" || verb === "PATCH" || verb === "PUT") {
+        init.body = JSON.stringify(params);
+        headers["Content-Type"] = "application/json";
+      } else {
+        url += "?_=" + encodeURIComponent(JSON.stringify(params));
+      }
+    }
+    const res = await fetch(url, init);
+    let body: any;
+    try {
+      body = await res.json();
+    } catch {
+      throw new ApiError(res.statusText, res.status);
+    }
+    return parseResponse<T>(body);
+  }
+}
+
+type Pending = { resolve: (v: any) => void; reject: (e: any) => void; onProgress?: (data: any) => void };
+
+export class WebSocketTransport implements Transport {
+  private ws: WebSocket;
+  private ready: Promise<void>;
+  private nextId = 0;
+  private pending = new Map<number, Pending>();
+  private handlers = new Map<string, ((msg: any) => void)[]>();
+
+  constructor(url: string) {
+    this.ws = new WebSocket(url);
+    this.ready = new Promise((resolve, reject) => {
+      this.ws.addEventListener("open", () => resolve());
+      this.ws.addEventListener("error", (e) => reject(e));
+    });
+    this.ws.addEventListener("message", (ev) => this.receive(JSON.parse(ev.data)));
+    this.ws.addEventListener("close", () => {
+      for (const p of this.pending.values()) {
+        p.reject(new ApiError("Connection closed", 0));
+      }
+      this.pending.clear();
+    });
+  }
+
+  // on registers a handler for messages that are not responses, such as events, based on
+  // their result field. Handlers registered with "*" receive all such messages.
+  on(result: string, fn: (msg: any) => void): void {
+    this.handlers.set(result, [...(this.handlers.get(result) ?? []), fn]);
+  }
+
+  close(): void {
+    this.ws.close();
+  }
+
+  async call<T>(path: string, verb: string, params?: any, onProgress?: (data: any) => void): Promise<T> {
+    await this.ready;
+    const id = ++this.nextId;
+    return new Promise<T>((resolve, reject) => {
+      this.pending.set(id, { resolve, reject, onProgress });
+      this.ws.send(JSON.stringify({ path, verb, params, query_id: id }));
+    });
+  }
+
+  private receive(msg: any): void {
+    const p = typeof msg.query_id === "number" ? this.pending.get(msg.query_id) : undefined;
+    if (p) {
+      if (msg.result === "progress") {
+        p.onProgress?.(msg.data);
+        return;
+      }
+      this.pending.delete(msg.query_id);
+      try {
+        p.resolve(parseResponse(msg));
+      } catch (e) {
+        p.reject(e);
+      }
+      return;
+    }
+    for (const fn of [...(this.handlers.get(msg.result) ?? []), ...(this.handlers.get("*") ?? [])]) {
+      fn(msg);
+    }
+  }
+}
+
+`
@@ -0,0 +1,350 @@
+package apirouter
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSignatureInvalid is returned when a signed request has a missing or invalid
+	// signature, or uses an unknown key.
+	ErrSignatureInvalid = &Error{Message: "Invalid request signature", Token: "error_signature_invalid", Code: http.StatusUnauthorized}
+
+	// ErrSignatureExpired is returned when the timestamp of a signed request is too far
+	// from the current time.
+	ErrSignatureExpired = &Error{Message: "Request signature has expired", Token: "error_signature_expired", Code: http.StatusUnauthorized}
+
+	// ErrSignatureReplayed is returned when the nonce of a signed request was already used.
+	ErrSignatureReplayed = &Error{Message: "Request was already processed", Token: "error_signature_replayed", Code: http.StatusUnauthorized}
+
+	// ErrNonceStoreFull is returned when a nonce cannot be recorded because the store is
+	// full of nonces that have not expired yet.
+	ErrNonceStoreFull = &Error{Message: "Too many signed requests, try again later", Token: "error_nonce_store_full", Code: http.StatusServiceUnavailable}
+)
+
+// Headers of signed requests, see [HMACVerifier].
+const (
+	SignatureKeyHeader       = "X-Signature-Key"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+	SignatureHeader          = "X-Signature"
+)
+
+const maxNonceLength = 128
+
+// HMACVerifier authenticates requests signed with HMAC-SHA256. Signed requests carry the
+// following headers:
+//
+//	X-Signature-Key: partner-2024
+//	X-Signature-Timestamp: 1700000000
+//	X-Signature-Nonce: 4f9a0c...
+//	X-Signature: <hex hmac-sha256 of the string below>
+//
+// The signature covers the method, the path including the query string, the timestamp,
+// the nonce and the sha256 of the body, each followed by a newline:
+//
+//	POST\n/_api/Webhook:order\n1700000000\n4f9a0c...\n<hex sha256 of body>\n
+//
+// Requests whose timestamp is more than MaxSkew away from the current time are rejected,
+// and each nonce can only be used once while its timestamp is valid. See [SignRequest]
+// for the client side.
+//
+// Several keys can be active at the same time, allowing keys to be rotated without
+// downtime: add the new key, move clients to it, then remove the old one.
+//
+//	v := &apirouter.HMACVerifier{}
+//	v.AddKey("partner-2024", secret)
+//	apirouter.RequestHooks = append(apirouter.RequestHooks, v.Hook)
+type HMACVerifier struct {
+	MaxSkew time.Duration // allowed difference between the timestamp and now, 5 minutes if zero
+	Nonces  NonceStore    // used nonces, a MemoryNonceStore of 100000 nonces if nil
+
+	// Resolve returns the user for a verified request signed with the given key. If nil,
+	// an *HMACKey is used as the user.
+	Resolve func(c *Context, keyId string) (any, error)
+
+	keys       map[string][]byte
+	lk         sync.RWMutex
+	noncesOnce sync.Once
+	nonces     NonceStore
+	verified   sync.Map // *http.Request → *hmacResult, see Hook
+}
+
+// hmacResult is the result of the verification of an http request.
+type hmacResult struct {
+	once sync.Once
+	user any
+	err  error
+}
+
+// HMACKey is the user of requests verified by an [HMACVerifier] without Resolve.
+type HMACKey struct {
+	Id string `json:"id"`
+}
+
+// AddKey adds or replaces the secret of the key with the given id.
+func (v *HMACVerifier) AddKey(id string, secret []byte) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	if v.keys == nil {
+		v.keys = make(map[string][]byte)
+	}
+	v.keys[id] = secret
+}
+
+// RemoveKey removes the key with the given id, requests signed with it are rejected.
+func (v *HMACVerifier) RemoveKey(id string) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	delete(v.keys, id)
+}
+
+func (v *HMACVerifier) key(id string) ([]byte, bool) {
+	v.lk.RLock()
+	defer v.lk.RUnlock()
+
+	k, ok := v.keys[id]
+	return k, ok
+}
+
+func (v *HMACVerifier) maxSkew() time.Duration {
+	if v.MaxSkew == 0 {
+		return 5 * time.Minute
+	}
+	return v.MaxSkew
+}
+
+func (v *HMACVerifier) nonceStore() NonceStore {
+	if v.Nonces != nil {
+		return v.Nonces
+	}
+	v.noncesOnce.Do(func() { v.nonces = NewMemoryNonceStore(100000) })
+	return v.nonces
+}
+
+// Hook is a RequestHook verifying signed requests. Requests without a X-Signature header
+// are left untouched, use a [Policy] to require authentication on routes. On success,
+// the request's user is set, see Resolve.
+//
+// Each http request is verified once: requests it carries, such as @batch entries,
+// websocket messages and JSON-RPC batch entries, share its result.
+func (v *HMACVerifier) Hook(c *Context) error {
+	req := c.req
+	if req == nil || req.Header.Get(SignatureHeader) == "" {
+		return nil
+	}
+	r, loaded := v.verified.LoadOrStore(req, &hmacResult{})
+	if !loaded {
+		context.AfterFunc(req.Context(), func() { v.verified.Delete(req) })
+	}
+	res := r.(*hmacResult)
+	res.once.Do(func() { res.user, res.err = v.authenticate(c, req) })
+	if res.err != nil {
+		return res.err
+	}
+	c.SetUser(res.user)
+	return nil
+}
+
+// authenticate verifies req and returns its user.
+func (v *HMACVerifier) authenticate(c *Context, req *http.Request) (any, error) {
+	keyId, err := v.Verify(c, req)
+	if err != nil {
+		return nil, err
+	}
+	if v.Resolve != nil {
+		return v.Resolve(c, keyId)
+	}
+	return &HMACKey{Id: keyId}, nil
+}
+
+// Verify checks the signature of req and records its nonce, and returns the id of the
+// key it was signed with. The request body must have been retained, which is the case for
+// bodies up to MaxJsonDataLength once the request was parsed, including chunked bodies.
+// Larger signed bodies are rejected with ErrRequestEntityTooLarge.
+func (v *HMACVerifier) Verify(ctx context.Context, req *http.Request) (string, error) {
+	keyId := req.Header.Get(SignatureKeyHeader)
+	nonce := req.Header.Get(SignatureNonceHeader)
+	sig, err := hex.DecodeString(req.Header.Get(SignatureHeader))
+	if err != nil || len(sig) != sha256.Size || nonce == "" || len(nonce) > maxNonceLength {
+		return "", ErrSignatureInvalid
+	}
+	ts, err := strconv.ParseInt(req.Header.Get(SignatureTimestampHeader), 10, 64)
+	if err != nil {
+		return "", ErrSignatureInvalid
+	}
+	secret, ok := v.key(keyId)
+	if !ok {
+		return "", ErrSignatureInvalid
+	}
+	body, err := signedBody(req)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(signRequest(secret, req.Method, req.URL.RequestURI(), ts, nonce, body), sig) {
+		return "", ErrSignatureInvalid
+	}
+
+	// only check time and nonce on authentic requests, so they cannot be used to fill
+	// the nonce store
+	t := time.Unix(ts, 0)
+	skew := v.maxSkew()
+	if d := time.Since(t); d > skew || d < -skew {
+		return "", ErrSignatureExpired
+	}
+	ok, err = v.nonceStore().UseNonce(ctx, keyId+":"+nonce, t.Add(skew))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrSignatureReplayed
+	}
+	return keyId, nil
+}
+
+// signedBody returns the body of req without consuming it. Bodies of MaxJsonDataLength
+// or more are not retained and cannot be checked.
+func signedBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		if req.ContentLength == 0 || req.Body == nil || req.Body == http.NoBody {
+			return nil, nil
+		}
+		// the body was too large to be retained when the request was parsed
+		return nil, ErrRequestEntityTooLarge
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	buf, err := io.ReadAll(io.LimitReader(body, MaxJsonDataLength))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) >= MaxJsonDataLength {
+		// never check the signature of a truncated body
+		return nil, ErrRequestEntityTooLarge
+	}
+	return buf, nil
+}
+
+// signRequest computes the signature of a request.
+func signRequest(secret []byte, method, uri string, ts int64, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, method+"\n"+uri+"\n"+strconv.FormatInt(ts, 10)+"\n"+nonce+"\n")
+	io.WriteString(mac, hex.EncodeToString(bodyHash[:])+"\n")
+	return mac.Sum(nil)
+}
+
+// SignRequest signs req for an [HMACVerifier] with the given key, setting the signature
+// headers with the current time and a random nonce. The body of req is read and replaced.
+func SignRequest(req *http.Request, keyId string, secret []byte) error {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(n)
+	ts := time.Now().Unix()
+
+	req.Header.Set(SignatureKeyHeader, keyId)
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(SignatureNonceHeader, nonce)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(signRequest(secret, req.Method, req.URL.RequestURI(), ts, nonce, body)))
+	return nil
+}
+
+// NonceStore records the nonces of signed requests to reject replays.
+type NonceStore interface {
+	// UseNonce records nonce until expires, and returns false if it was already recorded.
+	UseNonce(ctx context.Context, nonce string, expires time.Time) (bool, error)
+}
+
+// MemoryNonceStore is a [NonceStore] keeping up to a given number of nonces in memory.
+// Expired nonces are dropped, and new nonces are refused with ErrNonceStoreFull when the
+// store is full, as forgetting nonces that have not expired would allow replays.
+type MemoryNonceStore struct {
+	max    int
+	nonces map[string]time.Time
+	queue  nonceQueue
+	lk     sync.Mutex
+}
+
+// NewMemoryNonceStore returns a store holding up to max nonces.
+func NewMemoryNonceStore(max int) *MemoryNonceStore {
+	return &MemoryNonceStore{max: max, nonces: make(map[string]time.Time)}
+}
+
+func (s *MemoryNonceStore) UseNonce(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	now := time.Now()
+	for len(s.queue) > 0 && now.After(s.queue[0].expires) {
+		delete(s.nonces, heap.Pop(&s.queue).(*nonceEntry).nonce)
+	}
+
+	if exp, ok := s.nonces[nonce]; ok && !now.After(exp) {
+		return false, nil
+	}
+	if len(s.nonces) >= s.max {
+		return false, ErrNonceStoreFull
+	}
+	s.nonces[nonce] = expires
+	heap.Push(&s.queue, &nonceEntry{nonce: nonce, expires: expires})
+	return true, nil
+}
+
+// Len returns the number of nonces in the store.
+func (s *MemoryNonceStore) Len() int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return len(s.nonces)
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// nonceQueue is a heap of nonces ordered by expiry.
+type nonceQueue []*nonceEntry
+
+func (q nonceQueue) Len() int           { return len(q) }
+func (q nonceQueue) Less(i, j int) bool { return q[i].expires.Before(q[j].expires) }
+func (q nonceQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *nonceQueue) Push(x any)        { *q = append(*q, x.(*nonceEntry)) }
+func (q *nonceQueue) Pop() any {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
@@ -0,0 +1,267 @@
+package apirouter_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+var hmacSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func init() {
+	apirouter.RegisterStatic("HMACTest:whoami", func(ctx context.Context) (string, error) {
+		k := apirouter.GetUser[apirouter.HMACKey](ctx)
+		if k == nil {
+			return "", apirouter.ErrAccessDenied
+		}
+		return k.Id, nil
+	})
+}
+
+// newHMACVerifier installs a verifier with key "k1" until the end of the test.
+func newHMACVerifier(t *testing.T) *apirouter.HMACVerifier {
+	v := &apirouter.HMACVerifier{}
+	v.AddKey("k1", hmacSecret)
+	prev := apirouter.RequestHooks
+	apirouter.RequestHooks = append(apirouter.RequestHooks[:len(prev):len(prev)], v.Hook)
+	t.Cleanup(func() { apirouter.RequestHooks = prev })
+	return v
+}
+
+// signHeaders returns the signature headers of a request, as options for apiroutertest.
+func signHeaders(method, path string, body []byte, keyId string, secret []byte, ts time.Time, nonce string) []apiroutertest.Option {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n/%s\n%d\n%s\n%s\n", method, path, ts.Unix(), nonce, hex.EncodeToString(bodyHash[:]))
+
+	return []apiroutertest.Option{
+		apiroutertest.WithHeader(apirouter.SignatureKeyHeader, keyId),
+		apiroutertest.WithHeader(apirouter.SignatureTimestampHeader, strconv.FormatInt(ts.Unix(), 10)),
+		apiroutertest.WithHeader(apirouter.SignatureNonceHeader, nonce),
+		apiroutertest.WithHeader(apirouter.SignatureHeader, hex.EncodeToString(mac.Sum(nil))),
+	}
+}
+
+func TestHMACVerifier(t *testing.T) {
+	newHMACVerifier(t)
+
+	params := map[string]any{"a": 1}
+	body, _ := json.Marshal(params)
+	now := time.Now()
+	replayed := signHeaders("POST", "HMACTest:whoami", body, "k1", hmacSecret, now, "replay")
+
+	tests := []struct {
+		name   string
+		opts   []apiroutertest.Option
+		params any
+		err    string // expected error token, empty for success
+	}{
+		{"valid", signHeaders("POST", "HMACTest:whoami", body, "k1", hmacSecret, now, "n1"), params, ""},
+		{"unsigned", nil, params, "error_access_denied"},
+		{"first use", replayed, params, ""},
+		{"replayed", replayed, params, "error_signature_replayed"},
+		{"tampered body", signHeaders("POST", "HMACTest:whoami", body, "k1", hmacSecret, now, "n2"), map[string]any{"a": 2}, "error_signature_invalid"},
+		{"other path", signHeaders("POST", "HMACTest:other", body, "k1", hmacSecret, now, "n3"), params, "error_signature_invalid"},
+		{"wrong secret", signHeaders("POST", "HMACTest:whoami", body, "k1", []byte("fedcba9876543210fedcba9876543210"), now, "n4"), params, "error_signature_invalid"},
+		{"unknown key", signHeaders("POST", "HMACTest:whoami", body, "k2", hmacSecret, now, "n5"), params, "error_signature_invalid"},
+		{"expired", signHeaders("POST", "HMACTest:whoami", body, "k1", hmacSecret, now.Add(-time.Hour), "n6"), params, "error_signature_expired"},
+		{"future", signHeaders("POST", "HMACTest:whoami", body, "k1", hmacSecret, now.Add(time.Hour), "n7"), params, "error_signature_expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := apiroutertest.Call(t, "HMACTest:whoami", "POST", tt.params, tt.opts...)
+			if tt.err != "" {
+				res.ExpectError(tt.err)
+				return
+			}
+			var id string
+			res.ExpectSuccess().Decode(&id)
+			if id != "k1" {
+				t.Errorf("expected key k1, got %q", id)
+			}
+		})
+	}
+}
+
+// TestHMACVerifierBatch checks that requests of a signed @batch share its verification.
+func TestHMACVerifierBatch(t *testing.T) {
+	newHMACVerifier(t)
+
+	for _, parallel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallel=%v", parallel), func(t *testing.T) {
+			params := map[string]any{
+				"requests": []any{
+					map[string]any{"path": "HMACTest:whoami"},
+					map[string]any{"path": "HMACTest:whoami"},
+					map[string]any{"path": "HMACTest:whoami"},
+				},
+				"parallel": parallel,
+			}
+			body, _ := json.Marshal(params)
+			opts := signHeaders("POST", "@batch", body, "k1", hmacSecret, time.Now(), fmt.Sprintf("batch-%v", parallel))
+
+			var res []struct {
+				Result string `json:"result"`
+				Token  string `json:"token"`
+				Data   string `json:"data"`
+			}
+			apiroutertest.Call(t, "@batch", "POST", params, opts...).ExpectSuccess().Decode(&res)
+			if len(res) != 3 {
+				t.Fatalf("expected 3 responses, got %d", len(res))
+			}
+			for i, r := range res {
+				if r.Result != "success" || r.Data != "k1" {
+					t.Errorf("request %d: got %s %s %q", i, r.Result, r.Token, r.Data)
+				}
+			}
+		})
+	}
+}
+
+// TestHMACVerifierWS checks that messages on a websocket opened with a signed request
+// share its verification.
+func TestHMACVerifierWS(t *testing.T) {
+	newHMACVerifier(t)
+
+	ws := apiroutertest.NewWS(t, signHeaders("GET", "_websocket", nil, "k1", hmacSecret, time.Now(), "ws")...)
+	for i := 0; i < 3; i++ {
+		res := ws.Call("HMACTest:whoami", "GET", nil)
+		if res.Err != nil {
+			t.Fatalf("message %d failed: %s", i, res.Err)
+		}
+		if string(res.Data) != `"k1"` {
+			t.Errorf("message %d: expected k1, got %s", i, res.Data)
+		}
+	}
+}
+
+// TestHMACVerifierJSONRPC checks that entries of a signed JSON-RPC batch share its
+// verification.
+func TestHMACVerifierJSONRPC(t *testing.T) {
+	newHMACVerifier(t)
+
+	body := `[{"jsonrpc": "2.0", "method": "HMACTest:whoami", "id": 1}, {"jsonrpc": "2.0", "method": "HMACTest:whoami", "id": 2}]`
+	req := httptest.NewRequest("POST", "/rpc", strings.NewReader(body))
+	if err := apirouter.SignRequest(req, "k1", hmacSecret); err != nil {
+		t.Fatal(err)
+	}
+	hdr := req.Header.Clone()
+
+	res := rpcSigned(t, req)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 responses, got %v", res)
+	}
+	for _, r := range res {
+		if r["result"] != "k1" {
+			t.Errorf("unexpected response %v", r)
+		}
+	}
+
+	// the same signed request sent again is a replay
+	req = httptest.NewRequest("POST", "/rpc", strings.NewReader(body))
+	req.Header = hdr
+	for _, r := range rpcSigned(t, req) {
+		if r["error"] == nil {
+			t.Errorf("expected replayed request to fail, got %v", r)
+		}
+	}
+}
+
+func rpcSigned(t *testing.T, req *http.Request) []map[string]any {
+	t.Helper()
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	rw := httptest.NewRecorder()
+	apirouter.JSONRPC.ServeHTTP(rw, req.WithContext(ctx))
+
+	var res []map[string]any
+	if err := json.NewDecoder(bytes.NewReader(rw.Body.Bytes())).Decode(&res); err != nil {
+		t.Fatalf("failed to decode %s: %s", rw.Body.Bytes(), err)
+	}
+	return res
+}
+
+// chunkedSigned returns a signed request whose body has an unknown length, as when sent
+// with chunked transfer encoding.
+func chunkedSigned(t *testing.T, path, contentType string, body []byte) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/"+path, bytes.NewReader(body))
+	if err := apirouter.SignRequest(req, "k1", hmacSecret); err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = -1
+	req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body)))
+	req.GetBody = nil
+	return req
+}
+
+// TestHMACVerifierBodySize checks that chunked bodies are retained to be verified, and
+// that bodies too large to be retained are rejected rather than partially verified.
+func TestHMACVerifierBodySize(t *testing.T) {
+	v := newHMACVerifier(t)
+
+	var large bytes.Buffer
+	mw := multipart.NewWriter(&large)
+	fw, _ := mw.CreateFormFile("file", "large.bin")
+	fw.Write(make([]byte, apirouter.MaxJsonDataLength))
+	mw.Close()
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		code int
+		err  string // expected error token, empty for success
+	}{
+		{"chunked", chunkedSigned(t, "HMACTest:whoami", "application/json", []byte(`{"a": 1}`)), http.StatusOK, ""},
+		{"chunked json too large", chunkedSigned(t, "HMACTest:whoami", "application/json", bytes.Repeat([]byte(" "), int(apirouter.MaxJsonDataLength))), http.StatusRequestEntityTooLarge, "error_request_entity_too_large"},
+		{"chunked upload too large", chunkedSigned(t, "HMACTest:whoami", mw.FormDataContentType(), large.Bytes()), http.StatusRequestEntityTooLarge, "error_request_entity_too_large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			apirouter.HTTP.ServeHTTP(rw, tt.req)
+			var res struct {
+				Result string `json:"result"`
+				Token  string `json:"token"`
+				Data   string `json:"data"`
+			}
+			if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode %s: %s", rw.Body.Bytes(), err)
+			}
+			if rw.Code != tt.code || res.Token != tt.err {
+				t.Errorf("expected %d %q, got %d %q", tt.code, tt.err, rw.Code, res.Token)
+			}
+			if tt.err == "" && res.Data != "k1" {
+				t.Errorf("expected key k1, got %q", res.Data)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		// a body provided by GetBody is never verified partially
+		body := make([]byte, apirouter.MaxJsonDataLength)
+		req := httptest.NewRequest("POST", "/HMACTest:whoami", bytes.NewReader(body))
+		if err := apirouter.SignRequest(req, "k1", hmacSecret); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := v.Verify(context.Background(), req); err != apirouter.ErrRequestEntityTooLarge {
+			t.Errorf("expected ErrRequestEntityTooLarge, got %v", err)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package apirouter
 import (
 	"bytes"
 	"context"
+	"sync"
 
 	"github.com/KarpelesLab/pjson"
 	"github.com/coder/websocket"
@@ -30,6 +31,19 @@ func (e *encoderSink) SendResponse(r *Response) error {
 	return e.enc.Encode(r.getResponseData())
 }
 
+// syncSink serializes calls to a sink used by several requests at once.
+type syncSink struct {
+	sink ResponseSink
+	lk   sync.Mutex
+}
+
+func (s *syncSink) SendResponse(r *Response) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.sink.SendResponse(r)
+}
+
 type websocketSink struct {
 	ctx  context.Context
 	wsc  *websocket.Conn
@@ -37,21 +51,24 @@ type websocketSink struct {
 }
 
 func (w *websocketSink) SendResponse(r *Response) error {
+	buf, err := r.encode(w.cbor)
+	if err != nil {
+		return err
+	}
 	if w.cbor {
-		buf := &bytes.Buffer{}
-		enc := cbor.NewEncoder(buf)
-		err := enc.Encode(r.getResponseData())
-		if err != nil {
-			return err
-		}
-		return w.wsc.Write(w.ctx, websocket.MessageBinary, buf.Bytes())
-	} else {
-		buf := &bytes.Buffer{}
-		enc := pjson.NewEncoderContext(r.getJsonCtx(), buf)
-		err := enc.Encode(r.getResponseData())
-		if err != nil {
-			return err
-		}
-		return w.wsc.Write(w.ctx, websocket.MessageText, buf.Bytes())
+		return writeWS(w.ctx, w.wsc, websocket.MessageBinary, buf)
+	}
+	return writeWS(w.ctx, w.wsc, websocket.MessageText, buf)
+}
+
+// encode encodes the response as sent on persistent connections (websockets and
+// sockets), either as cbor or as json with protected fields hidden as needed.
+func (r *Response) encode(useCbor bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if useCbor {
+		err := cbor.NewEncoder(buf).Encode(r.getResponseData())
+		return buf.Bytes(), err
 	}
+	err := pjson.NewEncoderContext(r.getJsonCtx(), buf).Encode(r.getResponseData())
+	return buf.Bytes(), err
 }
@@ -6,6 +6,14 @@ func (c *Context) CallSpecial() (any, error) {
 	// p starts with a "@"
 
 	switch p {
+	case "@auth":
+		return c.wsAuth()
+	case "@batch":
+		return c.batch()
+	case "@schema":
+		return c.schema()
+	case "@admin/connections":
+		return c.adminConnections()
 	default:
 		return nil, ErrNotFound
 	}
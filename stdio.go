@@ -0,0 +1,74 @@
+package apirouter
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+)
+
+// ServeStdio serves the API on the process' standard input and output, for helper
+// processes spawned by a parent process. The protocol is the same as MakeJsonSocketFD,
+// including CBOR framing, and SocketHooks run when serving starts.
+//
+// Standard output is reserved for the protocol: anything else the process writes to it,
+// such as log messages or fmt.Print output, is sent to standard error instead.
+//
+// ServeStdio returns nil when standard input is closed. If ctx is done first, it stops
+// reading requests, waits for requests being processed and returns ctx's error.
+func ServeStdio(ctx context.Context, extraObjects map[string]any) error {
+	in, out, err := stdioFiles()
+	if err != nil {
+		return err
+	}
+	cl := newJsonClient(&stdioConn{in: in, out: out})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cl.serve(extraObjects)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if err := cl.stop(); err != nil {
+			// read deadlines are not supported on standard input on this platform, close
+			// it to interrupt the pending read
+			in.Close()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// stdioConn is a net.Conn reading from in and writing to out.
+type stdioConn struct {
+	in, out *os.File
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+func (s *stdioConn) Read(b []byte) (int, error)  { return s.in.Read(b) }
+func (s *stdioConn) Write(b []byte) (int, error) { return s.out.Write(b) }
+func (s *stdioConn) LocalAddr() net.Addr         { return stdioAddr{} }
+func (s *stdioConn) RemoteAddr() net.Addr        { return stdioAddr{} }
+
+func (s *stdioConn) Close() error {
+	s.in.Close()
+	return s.out.Close()
+}
+
+func (s *stdioConn) SetDeadline(t time.Time) error {
+	if err := s.in.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.out.SetWriteDeadline(t)
+}
+
+func (s *stdioConn) SetReadDeadline(t time.Time) error  { return s.in.SetReadDeadline(t) }
+func (s *stdioConn) SetWriteDeadline(t time.Time) error { return s.out.SetWriteDeadline(t) }
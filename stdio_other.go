@@ -0,0 +1,21 @@
+//go:build !unix
+
+package apirouter
+
+import (
+	"log"
+	"os"
+)
+
+// stdioFiles returns the files to use for the protocol on standard input and output.
+// os.Stdout is replaced with standard error so the program's output does not end up in
+// the protocol stream. Read deadlines may not be supported on in, in which case
+// ServeStdio closes it to stop reading.
+func stdioFiles() (in, out *os.File, err error) {
+	in, out = os.Stdin, os.Stdout
+	if log.Writer() == out {
+		log.SetOutput(os.Stderr)
+	}
+	os.Stdout = os.Stderr
+	return in, out, nil
+}
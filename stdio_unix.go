@@ -0,0 +1,33 @@
+//go:build unix
+
+package apirouter
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// stdioFiles returns the files to use for the protocol on standard input and output. The
+// standard output file descriptor is replaced with standard error so nothing else, child
+// processes included, can write to the protocol stream.
+func stdioFiles() (in, out *os.File, err error) {
+	ifd, err := unix.FcntlInt(0, unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// non blocking mode allows read deadlines on pipes, see ServeStdio
+	unix.SetNonblock(ifd, true)
+
+	ofd, err := unix.FcntlInt(1, unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(ifd)
+		return nil, nil, err
+	}
+	if err := unix.Dup2(2, 1); err != nil {
+		unix.Close(ifd)
+		unix.Close(ofd)
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(ifd), "stdin"), os.NewFile(uintptr(ofd), "stdout"), nil
+}
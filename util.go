@@ -1,8 +1,16 @@
 package apirouter
 
+import "io"
+
 func must[T any](v T, err error) T {
 	if err != nil {
 		panic(err)
 	}
 	return v
 }
+
+// readCloser combines a Reader with the Closer of the original body it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
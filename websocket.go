@@ -1,13 +1,13 @@
 package apirouter
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"sync"
+	"time"
 
-	"github.com/KarpelesLab/emitter"
 	"github.com/KarpelesLab/pjson"
 	"github.com/KarpelesLab/ringslice"
 	"github.com/coder/websocket"
@@ -17,36 +17,40 @@ import (
 var (
 	wsClients   = make(map[string]*Context)
 	wsclientsLk sync.RWMutex
-	wsDataQ     = must(ringslice.New[*emitter.Event](4096))
 )
 
-// BroadcastWS sends a message to all WebSocket clients subscribed to the "*" (wildcard) channel.
+// WebSocket protocol settings. Changes apply to connections opened afterwards.
+var (
+	// WSCompressionMode controls permessage-deflate negotiation. Compression is
+	// disabled by default.
+	WSCompressionMode = websocket.CompressionDisabled
+
+	// WSCompressionThreshold is the minimum size of a message before compression is
+	// applied. Zero uses the websocket library's default.
+	WSCompressionThreshold int
+
+	// WSReadLimit is the maximum size of a message received from a client. Files larger
+	// than this can be uploaded as chunked attachments.
+	WSReadLimit int64 = 128 * 1024
+)
+
+// BroadcastWS sends a message to all WebSocket and UNIX socket clients subscribed to the "*"
+// (wildcard) channel.
 // The data should typically be a map with "result" and "data" keys, e.g.:
 //
 //	apirouter.BroadcastWS(ctx, map[string]any{"result": "event", "type": "update", "data": payload})
 //
-// Messages are queued in a ring buffer and delivered asynchronously to all connected clients.
+// Messages are published through the current [Broker] and delivered asynchronously to all connected clients.
 func BroadcastWS(ctx context.Context, data any) error {
-	ev := &emitter.Event{
-		Context: ctx,
-		Topic:   "broadcast",
-		Args:    []any{"*", data},
-	}
-	_, err := wsDataQ.Append(ev)
-	return err
+	return GetBroker().Publish(ctx, "*", data)
 }
 
-// SendWS sends a message to all WebSocket clients subscribed to the specified channel.
+// SendWS sends a message to all WebSocket and UNIX socket clients subscribed to the specified
+// channel.
 // Only clients that have called SetListen(channel, true) will receive the message.
 // The data should typically be a map with "result" and "data" keys.
 func SendWS(ctx context.Context, channel string, data any) error {
-	ev := &emitter.Event{
-		Context: ctx,
-		Topic:   "broadcast",
-		Args:    []any{channel, data},
-	}
-	_, err := wsDataQ.Append(ev)
-	return err
+	return GetBroker().Publish(ctx, channel, data)
 }
 
 func listWsClients() []*Context {
@@ -61,10 +65,17 @@ func listWsClients() []*Context {
 }
 
 func (c *Context) prepareWebsocket() (any, error) {
-	var opts *websocket.AcceptOptions
+	if wsShutdown.Load() {
+		return nil, ErrServiceUnavailable("error_server_restart", "Server is restarting")
+	}
+
+	opts := &websocket.AcceptOptions{
+		CompressionMode:      WSCompressionMode,
+		CompressionThreshold: WSCompressionThreshold,
+	}
 	if c.csrfOk {
 		// csrf token is valid, so we accept any host
-		opts = &websocket.AcceptOptions{InsecureSkipVerify: true}
+		opts.InsecureSkipVerify = true
 	}
 
 	// return a *Response for websocket upgrade
@@ -107,10 +118,76 @@ func (c *Context) releaseWsClient() {
 	delete(wsClients, c.reqid)
 }
 
+// lastEventId returns the id of the last event the client received before reconnecting,
+// passed either as last_event_id in the query string or as a Last-Event-ID header.
+func (c *Context) lastEventId() string {
+	if id, ok := c.get["last_event_id"].(string); ok && id != "" {
+		return id
+	}
+	if c.req != nil {
+		return c.req.Header.Get("Last-Event-ID")
+	}
+	return ""
+}
+
+// wsReader returns a broker reader for this client, replaying missed events if the
+// client is resuming. If missed events are not available anymore, the client is sent
+// a message with result "gap" so it knows to refresh its state.
+func (c *Context) wsReader() (BrokerReader, error) {
+	b := GetBroker()
+	id := c.lastEventId()
+	if id == "" {
+		return b.Reader()
+	}
+
+	var r BrokerReader
+	var err error
+	gap := true
+	if rb, ok := b.(ReplayBroker); ok {
+		r, gap, err = rb.ReaderSince(id)
+	} else {
+		r, err = b.Reader()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if gap {
+		c.wsWrite(map[string]any{"result": "gap", "last_event_id": id})
+	}
+	return r, nil
+}
+
+// wsWrite encodes and sends data to the websocket client using the negotiated encoding.
+func (c *Context) wsWrite(data any) error {
+	switch c.accept[0] {
+	case "application/cbor":
+		bin, err := cbor.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return writeWS(c, c.wsc, websocket.MessageBinary, bin)
+	case "application/json":
+		fallthrough
+	default:
+		str, err := pjson.MarshalContext(pjson.ContextPublic(c), data)
+		if err != nil {
+			return err
+		}
+		return writeWS(c, c.wsc, websocket.MessageText, str)
+	}
+}
+
 func (c *Context) wsListen() {
 	defer c.wsc.CloseNow()
 
-	r := wsDataQ.BlockingCurrentReader()
+	r, err := c.wsReader()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	// ReadOne blocks until an event is published, release the reader on disconnect
+	stop := context.AfterFunc(c, func() { r.Close() })
+	defer stop()
 
 	// listen for messages on the broadcast system
 	for {
@@ -120,6 +197,19 @@ func (c *Context) wsListen() {
 		default:
 			// read from reader
 			ev, err := r.ReadOne()
+			if errors.Is(err, ringslice.ErrStaleReader) {
+				// we fell behind the whole buffer
+				rr, ok := r.(interface{ Reset() })
+				if !ok || c.ws.policy == OverflowDropConnection {
+					wsStats.slow.Add(1)
+					c.wsc.Close(websocket.StatusPolicyViolation, "slow_consumer")
+					return
+				}
+				c.ws.drop()
+				rr.Reset()
+				c.wsWrite(map[string]any{"result": "gap"})
+				continue
+			}
 			if err != nil {
 				return
 			}
@@ -134,37 +224,72 @@ func (c *Context) wsListen() {
 			if c.ListensFor(channel) {
 				switch c.accept[0] {
 				case "application/cbor":
-					bin, err := ev.EncodedArg(1, "cbor", cbor.Marshal)
+					bin, err := encodeEvent(ev, "cbor")
 					if err != nil {
 						continue
 					}
-					c.wsc.Write(c, websocket.MessageBinary, bin)
+					if !c.wsEnqueue(channel, ev.Args[1], websocket.MessageBinary, bin) {
+						return
+					}
 				case "application/json":
 					fallthrough
 				default:
-					str, err := ev.EncodedArg(1, "json", pjson.Marshal)
+					str, err := encodeEvent(ev, "json")
 					if err != nil {
 						continue
 					}
-					c.wsc.Write(c, websocket.MessageText, str)
+					if !c.wsEnqueue(channel, ev.Args[1], websocket.MessageText, str) {
+						return
+					}
 				}
 			}
 		}
 	}
 }
 
+// wsRequest handles one message received from the client, which is either a request or
+// an attachment chunk.
+func (c *Context) wsRequest(dat []byte, contentType string) *Response {
+	subCtx, err := NewChild(c, dat, contentType)
+	if err != nil {
+		return subCtx.errorResponse(err)
+	}
+	if subCtx.path != "@auth" {
+		// @auth can be used to restore an expired session
+		if err := c.wsCheckSession(); err != nil {
+			return subCtx.errorResponse(err)
+		}
+	}
+	if subCtx.chunk != nil {
+		return subCtx.handleAttachmentChunk()
+	}
+	if err := subCtx.wsResolveAttachments(); err != nil {
+		return subCtx.errorResponse(err)
+	}
+	subCtx.SetResponseSink(&websocketSink{ctx: subCtx, wsc: c.wsc, cbor: contentType == "application/cbor"})
+	res, _ := subCtx.Response()
+	return res
+}
+
 func (c *Context) handleWebsocket() {
 	defer c.wsc.CloseNow()
-	defer c.releaseWsClient()
-	c.registerWsClient()
 
 	var cancel func()
 	c.Context, cancel = context.WithCancel(c.Context)
 	defer cancel()
 
+	c.ws = newWsState()
+	defer c.ws.attach.release()
+	c.registerWsClient()
+	defer c.releaseWsClient()
+	c.presenceJoinAll()
+	defer c.presenceLeaveAll()
+
+	go c.wsWriter()
 	go c.wsListen()
+	go c.wsKeepalive()
 
-	c.wsc.SetReadLimit(128 * 1024)
+	c.wsc.SetReadLimit(WSReadLimit)
 
 	for {
 		mt, dat, err := c.wsc.Read(c)
@@ -175,46 +300,35 @@ func (c *Context) handleWebsocket() {
 			// slog.Debug?
 			return
 		}
+		c.ws.lastRead.Store(time.Now().UnixNano())
+		c.ws.msgsIn.Add(1)
+		c.ws.bytesIn.Add(uint64(len(dat)))
 
 		switch mt {
 		case websocket.MessageBinary:
 			// handle as cbor
-			var res *Response
-			subCtx, err := NewChild(c, dat, "application/cbor")
-			if err != nil {
-				res = subCtx.errorResponse(err)
-			} else {
-				subCtx.SetResponseSink(&websocketSink{ctx: subCtx, wsc: c.wsc, cbor: true})
-				res, _ = subCtx.Response()
-			}
-			buf := &bytes.Buffer{}
-			enc := cbor.NewEncoder(buf)
-			err = enc.Encode(res.getResponseData())
+			res := c.wsRequest(dat, "application/cbor")
+			buf, err := res.encode(true)
 			if err != nil {
 				// no really
 				c.wsc.Close(websocket.StatusInvalidFramePayloadData, err.Error())
 				return
 			}
-			c.wsc.Write(c, websocket.MessageBinary, buf.Bytes())
+			if err := writeWS(c, c.wsc, websocket.MessageBinary, buf); err != nil {
+				return
+			}
 		case websocket.MessageText:
 			// handle as json
-			var res *Response
-			subCtx, err := NewChild(c, dat, "application/json")
-			if err != nil {
-				res = subCtx.errorResponse(err)
-			} else {
-				subCtx.SetResponseSink(&websocketSink{ctx: subCtx, wsc: c.wsc, cbor: false})
-				res, _ = subCtx.Response()
-			}
-			buf := &bytes.Buffer{}
-			enc := pjson.NewEncoderContext(res.getJsonCtx(), buf)
-			err = enc.Encode(res.getResponseData())
+			res := c.wsRequest(dat, "application/json")
+			buf, err := res.encode(false)
 			if err != nil {
 				// no really
 				c.wsc.Close(websocket.StatusInvalidFramePayloadData, err.Error())
 				return
 			}
-			c.wsc.Write(c, websocket.MessageText, buf.Bytes())
+			if err := writeWS(c, c.wsc, websocket.MessageText, buf); err != nil {
+				return
+			}
 		default:
 		}
 	}
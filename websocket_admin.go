@@ -0,0 +1,122 @@
+package apirouter
+
+import (
+	"sort"
+	"time"
+)
+
+// AdminHook guards the @admin/connections endpoint. The endpoint is disabled (returns
+// ErrNotFound) while AdminHook is nil. The hook should return an error such as
+// ErrAccessDenied if the request is not allowed.
+//
+//	apirouter.AdminHook = func(c *apirouter.Context) error {
+//		if u := apirouter.GetUser[MyUser](c); u == nil || !u.IsAdmin {
+//			return apirouter.ErrAccessDenied
+//		}
+//		return nil
+//	}
+var AdminHook RequestHook
+
+// WSConnInfo describes a live websocket connection, see [ListWebsockets].
+type WSConnInfo struct {
+	Id            string    `json:"id"` // request id of the websocket upgrade request
+	User          any       `json:"user,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Domain        string    `json:"domain"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Subscriptions []string  `json:"subscriptions"`
+	BytesIn       uint64    `json:"bytes_in"`
+	BytesOut      uint64    `json:"bytes_out"`
+	MessagesIn    uint64    `json:"messages_in"`
+	MessagesOut   uint64    `json:"messages_out"`
+	Dropped       uint64    `json:"dropped"` // events dropped because the client could not keep up
+}
+
+// ListWebsockets returns information on all live websocket connections of this
+// instance, sorted by connection time.
+func ListWebsockets() []*WSConnInfo {
+	clients := listWsClients()
+	res := make([]*WSConnInfo, 0, len(clients))
+	for _, c := range clients {
+		res = append(res, c.wsInfo())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ConnectedAt.Before(res[j].ConnectedAt) })
+	return res
+}
+
+// DisconnectWebsocket closes the websocket connection with the given id with the
+// given reason. ErrNotFound is returned if no such connection exists.
+func DisconnectWebsocket(id, reason string) error {
+	wsclientsLk.RLock()
+	c, ok := wsClients[id]
+	wsclientsLk.RUnlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+	go c.CloseWebsocket(reason, 0)
+	return nil
+}
+
+// DisconnectUserWebsockets closes all websocket connections whose user matches, for
+// example after a password change, and returns the number of connections closed.
+//
+//	apirouter.DisconnectUserWebsockets(func(u any) bool {
+//		v, ok := u.(*MyUser)
+//		return ok && v.Id == userId
+//	}, "password_changed")
+func DisconnectUserWebsockets(match func(user any) bool, reason string) int {
+	var cnt int
+	for _, c := range listWsClients() {
+		if u := c.getUser(); u == nil || !match(u) {
+			continue
+		}
+		go c.CloseWebsocket(reason, 0)
+		cnt += 1
+	}
+	return cnt
+}
+
+func (c *Context) wsInfo() *WSConnInfo {
+	return &WSConnInfo{
+		Id:            c.reqid,
+		User:          c.getUser(),
+		RemoteAddr:    c.RemoteAddr(),
+		Domain:        c.GetDomain(),
+		ConnectedAt:   c.ws.connected,
+		Subscriptions: c.GetListen(),
+		BytesIn:       c.ws.bytesIn.Load(),
+		BytesOut:      c.ws.bytesOut.Load(),
+		MessagesIn:    c.ws.msgsIn.Load(),
+		MessagesOut:   c.ws.msgsOut.Load(),
+		Dropped:       c.ws.dropped.Load(),
+	}
+}
+
+// adminConnections implements @admin/connections. GET lists connections, DELETE with
+// an "id" parameter disconnects one connection.
+func (c *Context) adminConnections() (any, error) {
+	if AdminHook == nil {
+		return nil, ErrNotFound
+	}
+	if err := AdminHook(c); err != nil {
+		return nil, err
+	}
+
+	switch c.verb {
+	case "HEAD", "GET":
+		return ListWebsockets(), nil
+	case "DELETE":
+		id, ok := GetParam[string](c, "id")
+		if !ok || id == "" {
+			return nil, ErrBadRequest("error_missing_id", "parameter id is required")
+		}
+		reason := GetParamDefault(c, "reason", "disconnected")
+		if err := DisconnectWebsocket(id, reason); err != nil {
+			return nil, err
+		}
+		return map[string]any{"id": id}, nil
+	default:
+		return nil, ErrMethodNotAllowed("error_method_not_allowed", "method %s not allowed", c.verb)
+	}
+}
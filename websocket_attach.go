@@ -0,0 +1,196 @@
+package apirouter
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// WSMaxAttachmentSize is the maximum total size of attachments a single websocket
+	// connection may hold at any given time.
+	WSMaxAttachmentSize int64 = 8 << 20
+
+	// WSMaxTotalAttachmentSize is the maximum total size of attachments held by all
+	// websocket connections together.
+	WSMaxTotalAttachmentSize int64 = 256 << 20
+
+	// WSAttachmentTimeout is how long an attachment is kept without receiving a chunk
+	// or being used by a request.
+	WSAttachmentTimeout = time.Minute
+
+	wsAttachTotal atomic.Int64 // size of attachments held by all connections
+)
+
+// wsAttachmentChunk is one piece of a file uploaded over a websocket. Files larger
+// than the read limit are sent as multiple chunks with increasing offsets:
+//
+//	{"attachment": {"id": "a1", "filename": "photo.jpg", "offset": 0, "data": <bytes>}, "query_id": 1}
+//	{"attachment": {"id": "a1", "offset": 65536, "data": <bytes>, "final": true}, "query_id": 2}
+//
+// In JSON mode data is base64 encoded. Once final, the attachment can be referenced in
+// the parameters of a request as {"$attachment": "a1"}, and the handler will receive it
+// in the same form as a multipart upload: {"filename": "photo.jpg", "data": <bytes>}.
+type wsAttachmentChunk struct {
+	Id       string `json:"id"`
+	Filename string `json:"filename,omitempty"`
+	Offset   int64  `json:"offset"`
+	Data     []byte `json:"data"`
+	Final    bool   `json:"final,omitempty"`
+}
+
+type wsAttachment struct {
+	filename string
+	data     []byte
+	final    bool
+	updated  time.Time
+}
+
+type wsAttachments struct {
+	files map[string]*wsAttachment
+	size  int64
+	timer *time.Timer // expires idle attachments
+	lk    sync.Mutex
+}
+
+// remove drops an attachment, a.lk must be held.
+func (a *wsAttachments) remove(id string, f *wsAttachment) {
+	delete(a.files, id)
+	a.size -= int64(len(f.data))
+	wsAttachTotal.Add(-int64(len(f.data)))
+}
+
+// expire drops attachments idle for longer than WSAttachmentTimeout, and arms the timer
+// if attachments remain.
+func (a *wsAttachments) expire() {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	if a.files == nil {
+		// connection closed
+		return
+	}
+	now := time.Now()
+	for id, f := range a.files {
+		if now.Sub(f.updated) >= WSAttachmentTimeout {
+			a.remove(id, f)
+		}
+	}
+	if len(a.files) > 0 {
+		a.timer = time.AfterFunc(WSAttachmentTimeout, a.expire)
+	} else {
+		a.timer = nil
+	}
+}
+
+// release drops all attachments when the connection is closed.
+func (a *wsAttachments) release() {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	for id, f := range a.files {
+		a.remove(id, f)
+	}
+	a.files = nil
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+}
+
+// handleAttachmentChunk stores a received chunk on the connection and acknowledges it.
+func (c *Context) handleAttachmentChunk() *Response {
+	ch := c.chunk
+	if ch.Id == "" {
+		return c.errorResponse(ErrBadRequest("error_missing_id", "attachment id is required"))
+	}
+
+	a := &c.goTop().ws.attach
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	if a.files == nil {
+		a.files = make(map[string]*wsAttachment)
+	}
+	if a.timer == nil {
+		a.timer = time.AfterFunc(WSAttachmentTimeout, a.expire)
+	}
+	f, ok := a.files[ch.Id]
+	if !ok {
+		if ch.Offset != 0 {
+			return c.errorResponse(ErrBadRequest("error_bad_offset", "attachment %s does not exist", ch.Id))
+		}
+		f = &wsAttachment{filename: ch.Filename, updated: time.Now()}
+		a.files[ch.Id] = f
+	}
+	if f.final {
+		return c.errorResponse(ErrBadRequest("error_attachment_final", "attachment %s is already complete", ch.Id))
+	}
+	if ch.Offset != int64(len(f.data)) {
+		return c.errorResponse(ErrBadRequest("error_bad_offset", "expected offset %d for attachment %s", len(f.data), ch.Id))
+	}
+	n := int64(len(ch.Data))
+	if a.size+n > WSMaxAttachmentSize {
+		return c.errorResponse(ErrRequestEntityTooLarge)
+	}
+	if wsAttachTotal.Add(n) > WSMaxTotalAttachmentSize {
+		wsAttachTotal.Add(-n)
+		return c.errorResponse(ErrServiceUnavailable("error_attachment_capacity", "too many attachments are being uploaded, try again later"))
+	}
+
+	f.data = append(f.data, ch.Data...)
+	f.final = ch.Final
+	f.updated = time.Now()
+	if ch.Filename != "" {
+		f.filename = ch.Filename
+	}
+	a.size += int64(len(ch.Data))
+
+	return &Response{
+		Result:    "success",
+		Code:      http.StatusOK,
+		Time:      float64(time.Since(c.start)) / float64(time.Second),
+		RequestId: c.reqid,
+		QueryId:   c.qid,
+		Data:      map[string]any{"id": ch.Id, "size": len(f.data), "final": f.final},
+		ctx:       c,
+	}
+}
+
+// wsResolveAttachments replaces {"$attachment": id} parameters with the matching
+// attachment, removing it from the connection.
+func (c *Context) wsResolveAttachments() error {
+	top := c.goTop()
+	if top.ws == nil {
+		return nil
+	}
+	a := &top.ws.attach
+
+	for k, v := range c.params {
+		ref, ok := v.(map[string]any)
+		if !ok || len(ref) != 1 {
+			continue
+		}
+		id, ok := ref["$attachment"].(string)
+		if !ok {
+			continue
+		}
+
+		a.lk.Lock()
+		f, ok := a.files[id]
+		if ok && f.final {
+			a.remove(id, f)
+		}
+		a.lk.Unlock()
+
+		if !ok {
+			return ErrBadRequest("error_attachment_not_found", "attachment %s not found", id)
+		}
+		if !f.final {
+			return ErrBadRequest("error_attachment_incomplete", "attachment %s is not complete", id)
+		}
+		c.params[k] = map[string]any{"filename": f.filename, "data": f.data}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package apirouter
+
+import (
+	"net/http"
+	"time"
+)
+
+// SessionPolicy defines what happens to a websocket connection when its user session
+// expires or fails revalidation.
+type SessionPolicy int
+
+const (
+	// SessionClose closes the connection with reason "session_expired".
+	SessionClose SessionPolicy = iota
+	// SessionDowngrade removes the user from the connection, which continues as an
+	// anonymous connection. The client receives {"result": "session_expired"}.
+	SessionDowngrade
+)
+
+var (
+	// WSAuthHooks authenticate "@auth" messages sent on a websocket connection, such as:
+	//
+	//	{"path": "@auth", "verb": "POST", "params": {"token": "..."}}
+	//
+	// Hooks receive the @auth request context, and should read its parameters and call
+	// SetUser (and optionally SetUserExpiry) on it. On success, the user replaces the
+	// connection's user for all following requests and subscriptions. RequestHooks still
+	// run for requests on the connection, but the user, scopes and expiry they set are
+	// replaced by the ones set with @auth.
+	WSAuthHooks []RequestHook
+
+	// WSRevalidateHooks run with the connection's context before each request received
+	// on a websocket, and can check that the connection's user is still valid (token
+	// not revoked, etc). If a hook returns an error, the request fails and the session is
+	// ended according to WSSessionPolicy.
+	WSRevalidateHooks []RequestHook
+
+	// WSSessionPolicy is applied when a websocket session expires or fails revalidation.
+	WSSessionPolicy = SessionClose
+
+	// ListenAllowed, if set, is called for each subscription of a websocket connection
+	// when its user changes. Subscriptions the new user is not allowed to receive are
+	// removed.
+	ListenAllowed func(c *Context, channel string) bool
+
+	// ErrSessionExpired is returned for requests on a websocket connection whose session
+	// has expired.
+	ErrSessionExpired = &Error{Message: "Session has expired", Token: "error_session_expired", Code: http.StatusUnauthorized}
+)
+
+// wsApplyAuth restores the user, scopes and expiry of a websocket connection whose user
+// was set with @auth on c, a request received on that connection. RequestHooks run
+// before, and would otherwise authenticate again from the upgrade request and replace
+// the user.
+func (c *Context) wsApplyAuth() {
+	top := c.goTop()
+	if top == c || top.ws == nil || !top.ws.authed.Load() {
+		return
+	}
+
+	top.userLk.RLock()
+	user, expires, scopes := top.user, top.expires, top.scopes
+	top.userLk.RUnlock()
+
+	c.userLk.Lock()
+	defer c.userLk.Unlock()
+
+	c.user = user
+	c.expires = expires
+	c.scopes = scopes
+}
+
+// wsAuth implements the @auth special path.
+func (c *Context) wsAuth() (any, error) {
+	top := c.goTop()
+	if top == c || top.ws == nil || len(WSAuthHooks) == 0 {
+		return nil, ErrNotFound
+	}
+
+	// start from a clean state so hooks have to set the user
+	c.SetUser(nil)
+	c.SetUserExpiry(time.Time{})
+	c.SetScopes(nil)
+
+	for _, h := range WSAuthHooks {
+		if err := h(c); err != nil {
+			return nil, err
+		}
+	}
+
+	user := c.getUser()
+	if user == nil {
+		return nil, ErrAccessDenied
+	}
+
+	c.userLk.RLock()
+	expires := c.expires
+	c.userLk.RUnlock()
+
+	top.wsSetUser(user, expires, c.Scopes())
+	top.ws.authed.Store(true)
+
+	res := map[string]any{"user": user}
+	if !expires.IsZero() {
+		res["expires"] = expires
+	}
+	return res, nil
+}
+
+// wsSetUser changes the user and scopes of a websocket connection, updating presence
+// and subscriptions accordingly.
+func (c *Context) wsSetUser(user any, expires time.Time, scopes []string) {
+	c.presenceLeaveAll()
+
+	c.userLk.Lock()
+	c.user = user
+	c.expires = expires
+	c.scopes = scopes
+	c.userLk.Unlock()
+
+	if ListenAllowed != nil {
+		for _, ev := range c.GetListen() {
+			if !ListenAllowed(c, ev) {
+				c.SetListen(ev, false)
+			}
+		}
+	}
+
+	c.presenceJoinAll()
+}
+
+// wsCheckSession verifies the connection's session before a request is processed. It
+// returns an error if the session was ended.
+func (c *Context) wsCheckSession() error {
+	if c.wsSessionExpired() {
+		c.wsEndSession()
+		return ErrSessionExpired
+	}
+
+	for _, h := range WSRevalidateHooks {
+		if err := h(c); err != nil {
+			c.wsEndSession()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Context) wsSessionExpired() bool {
+	c.userLk.RLock()
+	defer c.userLk.RUnlock()
+
+	return c.user != nil && !c.expires.IsZero() && time.Now().After(c.expires)
+}
+
+// wsEndSession ends the user session of a websocket connection according to
+// WSSessionPolicy.
+func (c *Context) wsEndSession() {
+	switch WSSessionPolicy {
+	case SessionDowngrade:
+		if c.getUser() == nil {
+			return
+		}
+		// an empty list rather than nil, which would mean unrestricted
+		c.wsSetUser(nil, time.Time{}, []string{})
+		c.wsWrite(map[string]any{"result": "session_expired"})
+	default:
+		go c.CloseWebsocket("session_expired", 0)
+	}
+}
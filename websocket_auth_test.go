@@ -0,0 +1,83 @@
+package apirouter_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KarpelesLab/apirouter"
+	"github.com/KarpelesLab/apirouter/apiroutertest"
+)
+
+type wsAuthUser struct {
+	Name string
+}
+
+func init() {
+	apirouter.RegisterStatic("WSAuthTest:whoami", func(ctx context.Context) (any, error) {
+		var c *apirouter.Context
+		ctx.Value(&c)
+		u := apirouter.GetUser[wsAuthUser](ctx)
+		if u == nil {
+			return nil, apirouter.ErrAccessDenied
+		}
+		return map[string]any{"name": u.Name, "scopes": c.Scopes()}, nil
+	})
+}
+
+func TestWSAuthRequestHooks(t *testing.T) {
+	var calls atomic.Int32
+	prev := apirouter.RequestHooks
+	apirouter.RequestHooks = append(prev[:len(prev):len(prev)], func(c *apirouter.Context) error {
+		// authenticates from the upgrade request, as a cookie or header based hook would
+		calls.Add(1)
+		if apirouter.GetHeader(c, "X-Test-User") != "" {
+			c.SetUser(&wsAuthUser{Name: apirouter.GetHeader(c, "X-Test-User")})
+			c.SetScopes(nil)
+		}
+		return nil
+	})
+	prevAuth := apirouter.WSAuthHooks
+	apirouter.WSAuthHooks = append(prevAuth[:len(prevAuth):len(prevAuth)], func(c *apirouter.Context) error {
+		name, _ := apirouter.GetParam[string](c, "token")
+		c.SetUser(&wsAuthUser{Name: name})
+		c.SetScopes([]string{"read"})
+		return nil
+	})
+	t.Cleanup(func() {
+		apirouter.RequestHooks = prev
+		apirouter.WSAuthHooks = prevAuth
+	})
+
+	ws := apiroutertest.NewWS(t, apiroutertest.WithHeader("X-Test-User", "header"))
+	whoami := func() (name string, scopes []string) {
+		t.Helper()
+		res := ws.Call("WSAuthTest:whoami", "GET", nil)
+		if res.Err != nil {
+			t.Fatalf("whoami failed: %s", res.Err)
+		}
+		var out struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.Unmarshal(res.Data, &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Name, out.Scopes
+	}
+
+	if name, scopes := whoami(); name != "header" || scopes != nil {
+		t.Errorf("before @auth: got %s %v", name, scopes)
+	}
+	if res := ws.Call("@auth", "POST", map[string]any{"token": "authed"}); res.Err != nil {
+		t.Fatalf("@auth failed: %s", res.Err)
+	}
+	before := calls.Load()
+	if name, scopes := whoami(); name != "authed" || len(scopes) != 1 || scopes[0] != "read" {
+		t.Errorf("after @auth: got %s %v", name, scopes)
+	}
+	if calls.Load() == before {
+		t.Error("request hooks did not run after @auth")
+	}
+}
@@ -0,0 +1,150 @@
+package apirouter
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// WebSocket keepalive settings. Changes apply to connections opened afterwards.
+var (
+	// WSPingInterval is the interval at which clients are pinged. A client failing to
+	// answer a ping before the next one is due is disconnected. Zero disables pings.
+	WSPingInterval = 30 * time.Second
+
+	// WSIdleTimeout closes connections on which the client did not send any message for
+	// the given duration. Zero (the default) disables the idle timeout.
+	WSIdleTimeout time.Duration
+
+	// WSRestartReconnectDelay is the delay clients are asked to wait before reconnecting
+	// when connections are closed by [CloseAllWebsockets]. Each client receives a random
+	// delay between this value and twice this value so they do not all reconnect at once.
+	WSRestartReconnectDelay = time.Second
+)
+
+var (
+	// ErrNotWebsocket is returned when a websocket operation is attempted on a context
+	// that is not associated with a websocket connection.
+	ErrNotWebsocket = errors.New("not a websocket connection")
+
+	wsShutdown atomic.Bool
+)
+
+// CloseWebsocket closes the websocket connection associated with this context. The
+// client first receives a message such as:
+//
+//	{"result": "close", "reason": "server_restart", "reconnect_after": 1500}
+//
+// where reconnect_after is in milliseconds and only present if reconnectAfter is
+// positive, then the connection is closed with the reason as close frame reason.
+func (c *Context) CloseWebsocket(reason string, reconnectAfter time.Duration) error {
+	c = c.goTop()
+	if c.wsc == nil || c.ws == nil {
+		return ErrNotWebsocket
+	}
+	if !c.ws.closing.CompareAndSwap(false, true) {
+		// already closing
+		return nil
+	}
+
+	msg := map[string]any{"result": "close", "reason": reason}
+	if reconnectAfter > 0 {
+		msg["reconnect_after"] = reconnectAfter.Milliseconds()
+	}
+	c.wsWrite(msg)
+
+	code := websocket.StatusGoingAway
+	if reason == "server_restart" {
+		code = websocket.StatusServiceRestart
+	}
+	return c.wsc.Close(code, reason)
+}
+
+// CloseAllWebsockets closes all websocket connections with reason "server_restart" and
+// waits for their handlers to return, or for ctx to be done. New websocket connections
+// are refused once this has been called, making it suitable for graceful shutdown along
+// with [http.Server.Shutdown], which does not handle hijacked connections.
+func CloseAllWebsockets(ctx context.Context) error {
+	wsShutdown.Store(true)
+
+	for _, c := range listWsClients() {
+		delay := WSRestartReconnectDelay
+		if delay > 0 {
+			delay += time.Duration(rand.Int63n(int64(delay)))
+		}
+		go c.CloseWebsocket("server_restart", delay)
+	}
+
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		wsclientsLk.RLock()
+		cnt := len(wsClients)
+		wsclientsLk.RUnlock()
+		if cnt == 0 {
+			return nil
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			// force close remaining connections
+			for _, c := range listWsClients() {
+				c.wsc.CloseNow()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// wsKeepalive pings the client and enforces the idle timeout and session expiration
+// until the connection is closed.
+func (c *Context) wsKeepalive() {
+	ping, idle := WSPingInterval, WSIdleTimeout
+	tick := 5 * time.Second // session expiration check
+	if ping > 0 && ping < tick {
+		tick = ping
+	}
+	if idle > 0 && idle/2 < tick {
+		tick = idle / 2
+	}
+
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	lastPing := time.Now()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-t.C:
+		}
+
+		if idle > 0 && time.Since(time.Unix(0, c.ws.lastRead.Load())) > idle {
+			c.CloseWebsocket("idle_timeout", 0)
+			return
+		}
+
+		if c.wsSessionExpired() {
+			c.wsEndSession()
+		}
+
+		if ping > 0 && time.Since(lastPing) >= ping {
+			lastPing = time.Now()
+			ctx, cancel := context.WithTimeout(c, ping)
+			err := c.wsc.Ping(ctx)
+			cancel()
+			if err != nil {
+				// half-open connection
+				c.wsc.CloseNow()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package apirouter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// OverflowPolicy defines what happens when a WebSocket client's outbound queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest queued event to make room for the new one.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropConnection closes the connection of a client that cannot keep up.
+	OverflowDropConnection
+	// OverflowCoalesce replaces a queued event having the same key as the new one (see
+	// WSCoalesceKey), falling back to dropping the oldest event.
+	OverflowCoalesce
+)
+
+// WebSocket outbound queue settings. Changes apply to connections opened afterwards.
+var (
+	// WSQueueSize is the maximum number of events waiting to be sent to a single client.
+	WSQueueSize = 256
+
+	// WSWriteTimeout is the maximum time allowed to write a single message to a client.
+	// A client failing to accept a message in time is disconnected.
+	WSWriteTimeout = 10 * time.Second
+
+	// WSOverflowPolicy is applied when a client's queue is full.
+	WSOverflowPolicy = OverflowDropOldest
+
+	// WSCoalesceKey returns the key used by OverflowCoalesce to find events that replace
+	// each other, for example a document id for "document updated" events. Events with
+	// an empty key are never coalesced. If nil, the channel name is used.
+	WSCoalesceKey func(channel string, data any) string
+)
+
+// WSStats contains counters on WebSocket event delivery, see [GetWSStats].
+type WSStats struct {
+	Sent            uint64 `json:"sent"`             // events written to clients
+	Dropped         uint64 `json:"dropped"`          // events dropped because a client could not keep up
+	Coalesced       uint64 `json:"coalesced"`        // events replaced by a newer event with the same key
+	SlowDisconnects uint64 `json:"slow_disconnects"` // connections closed because they could not keep up
+}
+
+var wsStats struct {
+	sent, dropped, coalesced, slow atomic.Uint64
+}
+
+// GetWSStats returns event delivery counters for all WebSocket clients since startup.
+func GetWSStats() WSStats {
+	return WSStats{
+		Sent:            wsStats.sent.Load(),
+		Dropped:         wsStats.dropped.Load(),
+		Coalesced:       wsStats.coalesced.Load(),
+		SlowDisconnects: wsStats.slow.Load(),
+	}
+}
+
+type wsMessage struct {
+	typ  websocket.MessageType
+	data []byte
+	key  string
+}
+
+// wsState holds the per-connection state of a websocket client.
+type wsState struct {
+	q      []wsMessage
+	qLk    sync.Mutex
+	notify chan struct{}
+	size   int
+	policy OverflowPolicy
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+
+	connected time.Time
+	bytesIn   atomic.Uint64
+	bytesOut  atomic.Uint64
+	msgsIn    atomic.Uint64
+	msgsOut   atomic.Uint64
+	lastRead  atomic.Int64 // unix nano timestamp of the last message received
+	closing   atomic.Bool
+	authed    atomic.Bool // user was set with @auth, see wsAuth
+
+	attach wsAttachments
+}
+
+func newWsState() *wsState {
+	size := WSQueueSize
+	if size <= 0 {
+		size = 1
+	}
+	s := &wsState{
+		notify:    make(chan struct{}, 1),
+		size:      size,
+		policy:    WSOverflowPolicy,
+		connected: time.Now(),
+	}
+	s.lastRead.Store(time.Now().UnixNano())
+	return s
+}
+
+// push queues a message for sending, applying the overflow policy if the queue is
+// full. It returns false if the connection should be dropped.
+func (s *wsState) push(m wsMessage) bool {
+	s.qLk.Lock()
+	defer s.qLk.Unlock()
+
+	if len(s.q) >= s.size {
+		switch s.policy {
+		case OverflowDropConnection:
+			s.drop()
+			return false
+		case OverflowCoalesce:
+			if m.key != "" {
+				for n := range s.q {
+					if s.q[n].key == m.key {
+						s.q[n] = m
+						wsStats.coalesced.Add(1)
+						return true
+					}
+				}
+			}
+			fallthrough
+		default:
+			copy(s.q, s.q[1:])
+			s.q = s.q[:len(s.q)-1]
+			s.drop()
+		}
+	}
+
+	s.q = append(s.q, m)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *wsState) pop() (wsMessage, bool) {
+	s.qLk.Lock()
+	defer s.qLk.Unlock()
+
+	if len(s.q) == 0 {
+		return wsMessage{}, false
+	}
+	m := s.q[0]
+	s.q[0] = wsMessage{}
+	s.q = s.q[1:]
+	return m, true
+}
+
+func (s *wsState) drop() {
+	s.dropped.Add(1)
+	wsStats.dropped.Add(1)
+}
+
+// wsWriter sends queued messages to the client until the connection is closed.
+func (c *Context) wsWriter() {
+	defer c.wsc.CloseNow()
+
+	for {
+		m, ok := c.ws.pop()
+		if !ok {
+			select {
+			case <-c.Done():
+				return
+			case <-c.ws.notify:
+			}
+			continue
+		}
+		if err := writeWS(c, c.wsc, m.typ, m.data); err != nil {
+			return
+		}
+		c.ws.sent.Add(1)
+		wsStats.sent.Add(1)
+	}
+}
+
+// wsEnqueue queues an event for this client. If the client cannot keep up and the
+// policy requires it, the connection is closed and false is returned.
+func (c *Context) wsEnqueue(channel string, data any, typ websocket.MessageType, buf []byte) bool {
+	m := wsMessage{typ: typ, data: buf}
+	if c.ws.policy == OverflowCoalesce {
+		if WSCoalesceKey != nil {
+			m.key = WSCoalesceKey(channel, data)
+		} else {
+			m.key = channel
+		}
+	}
+	if !c.ws.push(m) {
+		wsStats.slow.Add(1)
+		c.wsc.Close(websocket.StatusPolicyViolation, "slow_consumer")
+		return false
+	}
+	return true
+}
+
+// writeWS writes a message to wsc, giving up after WSWriteTimeout. If ctx belongs to a
+// websocket client, its output counters are updated.
+func writeWS(ctx context.Context, wsc *websocket.Conn, typ websocket.MessageType, data []byte) error {
+	var c *Context
+	ctx.Value(&c)
+
+	if WSWriteTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, WSWriteTimeout)
+		defer cancel()
+	}
+	err := wsc.Write(ctx, typ, data)
+	if err == nil && c != nil {
+		if s := c.goTop().ws; s != nil {
+			s.msgsOut.Add(1)
+			s.bytesOut.Add(uint64(len(data)))
+		}
+	}
+	return err
+}